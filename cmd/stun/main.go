@@ -0,0 +1,191 @@
+// Command stun is a STUN client. It prints the server reflexive address and optionally runs NAT behavior tests.
+//
+//	stun [flags] stun:stun.l.google.com:19302
+//	stun -nat -json stuns:user:password@example.org
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pixelbender/go-stun/stun"
+)
+
+var (
+	count    = flag.Int("n", 1, "number of Binding requests, at least 1")
+	timeout  = flag.Duration("timeout", stun.DefaultConfig.TransactionTimeout, "transaction timeout")
+	user     = flag.String("user", "", "username of long-term credentials, overrides the URI, requires -password")
+	password = flag.String("password", "", "password of long-term credentials")
+	nat      = flag.Bool("nat", false, "run NAT mapping, filtering and hairpinning tests (RFC 5780)")
+	classic  = flag.Bool("classic", false, "run NAT type discovery against an RFC 3489 server")
+	jsonOut  = flag.Bool("json", false, "print results as JSON")
+	verbose  = flag.Bool("v", false, "print sent and received messages to stderr")
+)
+
+type result struct {
+	Server      string     `json:"server"`
+	Local       string     `json:"local,omitempty"`
+	Mapped      string     `json:"mapped,omitempty"`
+	Requests    []*request `json:"requests,omitempty"`
+	Mapping     *test      `json:"mapping,omitempty"`
+	Filtering   *test      `json:"filtering,omitempty"`
+	Hairpinning *test      `json:"hairpinning,omitempty"`
+	NATType     *test      `json:"natType,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type request struct {
+	Mapped string  `json:"mapped,omitempty"`
+	RTT    float64 `json:"rttMs"`
+	Error  string  `json:"error,omitempty"`
+}
+
+type test struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newTest(r string, err error) *test {
+	if err != nil {
+		return &test{Error: err.Error()}
+	}
+	return &test{Result: r}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: stun [flags] stun:host[:port]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *user != "" && *password == "" {
+		fmt.Fprintln(os.Stderr, "stun: -user requires -password")
+		os.Exit(2)
+	}
+	if *count < 1 {
+		fmt.Fprintln(os.Stderr, "stun: -n must be at least 1")
+		os.Exit(2)
+	}
+	r := run(flag.Arg(0))
+	if *jsonOut {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(r)
+	} else {
+		printText(r)
+	}
+	if r.Error != "" {
+		os.Exit(1)
+	}
+}
+
+func run(uri string) *result {
+	r := &result{Server: uri}
+	config := stun.DefaultConfig.Clone()
+	config.TransactionTimeout = *timeout
+	if *user != "" {
+		config.AuthMethod = stun.LongTermAuthMethod(*user, *password)
+	}
+	if *verbose {
+		config.Logf = func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}
+	}
+	u, err := stun.ParseURI(uri)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	if *user != "" {
+		u.Username, u.Password = "", ""
+	}
+	conn, err := stun.DialURI(u, config)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer conn.Close()
+	r.Local = conn.LocalAddr().String()
+
+	var mapped net.Addr
+	for i := 0; i < *count; i++ {
+		start := time.Now()
+		addr, err := conn.Discover()
+		req := &request{RTT: float64(time.Since(start)) / float64(time.Millisecond)}
+		if err != nil {
+			req.Error = err.Error()
+		} else {
+			req.Mapped, mapped = addr.String(), addr
+		}
+		r.Requests = append(r.Requests, req)
+	}
+	if mapped == nil {
+		r.Error = r.Requests[len(r.Requests)-1].Error
+		return r
+	}
+	r.Mapped = mapped.String()
+
+	if *nat || *classic {
+		d := stun.NewDetector(conn)
+		if *nat {
+			r.Mapping = newTest(d.Mapping())
+			r.Filtering = newTest(d.Filtering())
+			r.Hairpinning = newTest("ok", d.Hairpinning())
+		}
+		if *classic {
+			r.NATType = newTest(d.NATType())
+		}
+	}
+	return r
+}
+
+func printText(r *result) {
+	line := func(name string, v interface{}) {
+		fmt.Printf("%-12s %v\n", name, v)
+	}
+	if r.Local != "" {
+		line("local", r.Local)
+	}
+	for i, it := range r.Requests {
+		name := "request"
+		if len(r.Requests) > 1 {
+			name = fmt.Sprintf("request %d", i+1)
+		}
+		if it.Error != "" {
+			line(name, fmt.Sprintf("%.1fms %v", it.RTT, it.Error))
+		} else {
+			line(name, fmt.Sprintf("%.1fms", it.RTT))
+		}
+	}
+	if r.Mapped != "" {
+		line("mapped", r.Mapped)
+	}
+	for _, it := range []struct {
+		name string
+		t    *test
+	}{
+		{"mapping", r.Mapping},
+		{"filtering", r.Filtering},
+		{"hairpinning", r.Hairpinning},
+		{"nat type", r.NATType},
+	} {
+		switch {
+		case it.t == nil:
+		case it.t.Error != "":
+			line(it.name, "error: "+it.t.Error)
+		default:
+			line(it.name, it.t.Result)
+		}
+	}
+	if r.Error != "" {
+		fmt.Fprintln(os.Stderr, r.Error)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// config is the daemon configuration file.
+//
+// Changes of listeners, RFC 5780 addresses, the metrics address and agent settings take effect on restart.
+// Credentials, rate limits, IP filters and TLS certificates are applied on reload.
+type config struct {
+	// Listen contains listeners, e.g. {"network": "udp", "address": ":3478"}
+	Listen []listener `json:"listen"`
+	// RFC5780, if set the server listens on four UDP addresses combined from two IP addresses and two ports
+	RFC5780 *rfc5780 `json:"rfc5780,omitempty"`
+
+	Software          string `json:"software,omitempty"`
+	Fingerprint       bool   `json:"fingerprint,omitempty"`
+	Workers           int    `json:"workers,omitempty"`
+	QueueSize         int    `json:"queueSize,omitempty"`
+	LimitResponseSize bool   `json:"limitResponseSize,omitempty"`
+
+	// Realm, if set requests are authenticated using long-term credentials of Users
+	Realm string            `json:"realm,omitempty"`
+	Users map[string]string `json:"users,omitempty"`
+
+	RateLimit *rateLimit `json:"rateLimit,omitempty"`
+	Allow     []string   `json:"allow,omitempty"`
+	Deny      []string   `json:"deny,omitempty"`
+
+	// Metrics, if set is the address of the HTTP server exporting metrics at /metrics
+	Metrics string `json:"metrics,omitempty"`
+	// Log is the log level: debug, info, warn or error
+	Log string `json:"log,omitempty"`
+}
+
+type listener struct {
+	// Network is udp, tcp or tls
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Cert    string `json:"cert,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+type rfc5780 struct {
+	Primary   string `json:"primary"`
+	Alternate string `json:"alternate"`
+	Port      int    `json:"port"`
+	AltPort   int    `json:"altPort"`
+}
+
+type rateLimit struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	IPv4Prefix int     `json:"ipv4Prefix,omitempty"`
+	IPv6Prefix int     `json:"ipv6Prefix,omitempty"`
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err = d.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Listen) == 0 && c.RFC5780 == nil {
+		return errors.New("no listeners")
+	}
+	for _, it := range c.Listen {
+		base := strings.TrimRight(it.Network, "46")
+		switch base {
+		case "udp", "tcp":
+		case "tls":
+			if it.Cert == "" || it.Key == "" {
+				return fmt.Errorf("listener %s: cert and key are required", it.Address)
+			}
+		default:
+			return fmt.Errorf("listener %s: unsupported network %q", it.Address, it.Network)
+		}
+		if _, _, err := net.SplitHostPort(it.Address); err != nil {
+			return fmt.Errorf("listener %s: %v", it.Address, err)
+		}
+	}
+	if c.Realm != "" && len(c.Users) == 0 {
+		return errors.New("realm is set without users")
+	}
+	if r := c.RateLimit; r != nil && (r.Rate <= 0 || r.Burst <= 0) {
+		return errors.New("rate limit requires positive rate and burst")
+	}
+	switch c.Log {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unsupported log level %q", c.Log)
+	}
+	return nil
+}
+
+// restartRequired reports which settings of c differ from the running configuration r and are not reloaded.
+func (c *config) restartRequired(r *config) []string {
+	var d []string
+	eq := func(a, b interface{}) bool {
+		x, _ := json.Marshal(a)
+		y, _ := json.Marshal(b)
+		return string(x) == string(y)
+	}
+	if !eq(c.Listen, r.Listen) {
+		d = append(d, "listen")
+	}
+	if !eq(c.RFC5780, r.RFC5780) {
+		d = append(d, "rfc5780")
+	}
+	if c.Software != r.Software || c.Fingerprint != r.Fingerprint || c.Workers != r.Workers ||
+		c.QueueSize != r.QueueSize || c.LimitResponseSize != r.LimitResponseSize {
+		d = append(d, "agent settings")
+	}
+	if c.Metrics != r.Metrics {
+		d = append(d, "metrics")
+	}
+	return d
+}
@@ -0,0 +1,290 @@
+// Command stund is a STUN server daemon.
+//
+//	stund -config /etc/stund.json
+//
+// The configuration file is JSON, e.g.
+//
+//	{
+//		"listen": [
+//			{"network": "udp", "address": ":3478"},
+//			{"network": "tcp", "address": ":3478"},
+//			{"network": "tls", "address": ":5349", "cert": "cert.pem", "key": "key.pem"}
+//		],
+//		"rfc5780": {"primary": "192.0.2.1", "alternate": "192.0.2.2", "port": 3480, "altPort": 3481},
+//		"realm": "example.org",
+//		"users": {"user": "password"},
+//		"rateLimit": {"rate": 10, "burst": 20},
+//		"deny": ["10.0.0.0/8"],
+//		"metrics": "127.0.0.1:9478"
+//	}
+//
+// SIGHUP reloads credentials, rate limits, IP filters, TLS certificates and the log level.
+// SIGINT and SIGTERM close listeners and the metrics server and exit.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pixelbender/go-stun/stun"
+)
+
+var configPath = flag.String("config", "/etc/stund.json", "configuration file")
+
+// shutdownTimeout limits the graceful shutdown of the STUN and metrics servers.
+const shutdownTimeout = 5 * time.Second
+
+func main() {
+	flag.Parse()
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	d, err := start(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				d.reload(*configPath)
+				continue
+			}
+			d.log.Info("shutting down", "signal", s.String())
+			d.shutdown()
+			return
+		case err := <-d.errc:
+			d.log.Error("server failed", "error", err)
+			d.shutdown()
+			os.Exit(1)
+		}
+	}
+}
+
+type daemon struct {
+	config  *config
+	log     *slog.Logger
+	level   slog.LevelVar
+	srv     *stun.Server
+	metrics *http.Server
+	certs   []*certificate
+
+	// next is the server handler, chain is the reloadable middleware chain calling it
+	next  stun.Handler
+	chain atomic.Value
+
+	wg      sync.WaitGroup
+	closing int32
+	errc    chan error
+}
+
+// certificate is a TLS certificate replaced on reload.
+type certificate struct {
+	cert, key string
+	v         atomic.Value
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.v.Load().(*tls.Certificate), nil
+}
+
+func start(c *config) (*daemon, error) {
+	d := &daemon{config: c, errc: make(chan error, len(c.Listen)+2)}
+	d.log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &d.level}))
+
+	ac := stun.DefaultConfig.Clone()
+	if c.Software != "" {
+		ac.Software = c.Software
+	}
+	ac.Fingerprint = c.Fingerprint
+	ac.Workers = c.Workers
+	ac.QueueSize = c.QueueSize
+	ac.LimitResponseSize = c.LimitResponseSize
+	// Messages are traced only at debug level, which may be enabled on reload.
+	ac.Tracer = stun.NewSlogTracer(d.log)
+	var metrics *stun.PrometheusMetrics
+	if c.Metrics != "" {
+		metrics = stun.NewPrometheusMetrics()
+		ac.Metrics = metrics
+	}
+	d.srv = stun.NewServer(ac)
+	d.srv.Use(func(h stun.Handler) stun.Handler {
+		d.next = h
+		return stun.HandlerFunc(func(w stun.ResponseWriter, msg *stun.Message) {
+			d.chain.Load().(stun.Handler).ServeSTUN(w, msg)
+		})
+	})
+	for _, it := range c.Listen {
+		if strings.HasPrefix(it.Network, "tls") {
+			d.certs = append(d.certs, &certificate{cert: it.Cert, key: it.Key})
+		}
+	}
+	if err := d.apply(c); err != nil {
+		return nil, err
+	}
+
+	var serve []func() error
+	fail := func(err error) (*daemon, error) {
+		d.srv.Close()
+		return nil, err
+	}
+	certs := d.certs
+	for _, it := range c.Listen {
+		addr := it.Address
+		switch network := it.Network; {
+		case strings.HasPrefix(network, "udp"):
+			conn, err := net.ListenPacket(network, addr)
+			if err != nil {
+				return fail(err)
+			}
+			serve = append(serve, func() error { return d.srv.Serve(conn) })
+		case strings.HasPrefix(network, "tcp"):
+			l, err := net.Listen(network, addr)
+			if err != nil {
+				return fail(err)
+			}
+			serve = append(serve, func() error { return d.srv.ServeListener(l) })
+		default:
+			l, err := net.Listen("tcp"+strings.TrimPrefix(network, "tls"), addr)
+			if err != nil {
+				return fail(err)
+			}
+			l = tls.NewListener(l, &tls.Config{GetCertificate: certs[0].get})
+			certs = certs[1:]
+			serve = append(serve, func() error { return d.srv.ServeListener(l) })
+		}
+		d.log.Info("listening", "network", it.Network, "address", addr)
+	}
+	if r := c.RFC5780; r != nil {
+		serve = append(serve, func() error {
+			return d.srv.ListenAndServeRFC5780(r.Primary, r.Alternate, r.Port, r.AltPort)
+		})
+		d.log.Info("listening", "network", "udp", "rfc5780", fmt.Sprintf("%s,%s:%d,%d", r.Primary, r.Alternate, r.Port, r.AltPort))
+	}
+	if metrics != nil {
+		l, err := net.Listen("tcp", c.Metrics)
+		if err != nil {
+			return fail(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		d.metrics = &http.Server{Handler: mux}
+		serve = append(serve, func() error { return d.metrics.Serve(l) })
+		d.log.Info("metrics", "address", l.Addr().String())
+	}
+	for _, it := range serve {
+		d.wg.Add(1)
+		go func(serve func() error) {
+			defer d.wg.Done()
+			err := serve()
+			if atomic.LoadInt32(&d.closing) == 0 {
+				d.errc <- err
+			}
+		}(it)
+	}
+	return d, nil
+}
+
+// apply replaces the middleware chain, TLS certificates and the log level. Nothing is replaced on error.
+func (d *daemon) apply(c *config) error {
+	h := d.next
+	if c.Realm != "" {
+		users := c.Users
+		h = stun.LongTermAuth(c.Realm, func(username string) (string, bool) {
+			p, ok := users[username]
+			return p, ok
+		})(h)
+	}
+	if r := c.RateLimit; r != nil {
+		l := stun.NewRateLimiter(r.Rate, r.Burst)
+		l.IPv4Prefix, l.IPv6Prefix = r.IPv4Prefix, r.IPv6Prefix
+		h = stun.RateLimit(l)(h)
+	}
+	if len(c.Allow) > 0 || len(c.Deny) > 0 {
+		allow, err := stun.ParseCIDRs(c.Allow...)
+		if err != nil {
+			return err
+		}
+		deny, err := stun.ParseCIDRs(c.Deny...)
+		if err != nil {
+			return err
+		}
+		h = stun.FilterIP(allow, deny)(h)
+	}
+	certs := make([]*tls.Certificate, len(d.certs))
+	for i, it := range d.certs {
+		cert, err := tls.LoadX509KeyPair(it.cert, it.key)
+		if err != nil {
+			return err
+		}
+		certs[i] = &cert
+	}
+	for i, it := range d.certs {
+		it.v.Store(certs[i])
+	}
+	d.chain.Store(h)
+	d.level.Set(logLevel(c.Log))
+	return nil
+}
+
+func (d *daemon) reload(path string) {
+	c, err := loadConfig(path)
+	if err == nil {
+		err = d.apply(c)
+	}
+	if err != nil {
+		d.log.Error("reload failed", "error", err)
+		return
+	}
+	if r := c.restartRequired(d.config); r != nil {
+		d.log.Warn("reloaded, restart to apply changes", "settings", strings.Join(r, ", "))
+	} else {
+		d.log.Info("reloaded")
+	}
+}
+
+// shutdown waits for running handlers and the metrics server to finish requests and closes listeners.
+func (d *daemon) shutdown() {
+	atomic.StoreInt32(&d.closing, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := d.srv.Shutdown(ctx); err != nil {
+		d.log.Warn("handlers are not finished", "error", err)
+	}
+	if d.metrics != nil {
+		if err := d.metrics.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			d.log.Error("metrics shutdown failed", "error", err)
+		}
+	}
+	d.wg.Wait()
+}
+
+func logLevel(s string) slog.Level {
+	switch s {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,77 @@
+// Command stundump decodes hex or base64 dumps of STUN messages, e.g. copied from Wireshark.
+//
+//	stundump 000100002112a442...
+//	echo AAEAACESpEI... | stundump -user user -realm example.org -password secret
+//
+// Each argument is a message, or the standard input if there are no arguments.
+// Attributes are printed with offsets, lengths, padding and decoded values.
+// MESSAGE-INTEGRITY is verified if credentials are given. It exits with status 1 if a message is malformed.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pixelbender/go-stun/stun"
+)
+
+var (
+	key      = flag.String("key", "", "MESSAGE-INTEGRITY key in hex")
+	user     = flag.String("user", "", "username of long-term credentials")
+	realm    = flag.String("realm", "", "realm of long-term credentials")
+	password = flag.String("password", "", "password, a short-term key unless -user is set")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: stundump [flags] [dump...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	k, err := integrityKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	dumps := flag.Args()
+	if len(dumps) == 0 {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dumps = []string{string(b)}
+	}
+	status := 0
+	for i, it := range dumps {
+		if i > 0 {
+			fmt.Println()
+		}
+		b, err := stun.ParseDump(it)
+		if err == nil {
+			err = stun.Dump(os.Stdout, b, k)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func integrityKey() ([]byte, error) {
+	switch {
+	case *key != "":
+		return hex.DecodeString(*key)
+	case *user != "":
+		h := md5.Sum([]byte(*user + ":" + *realm + ":" + *password))
+		return h[:], nil
+	case *password != "":
+		return []byte(*password), nil
+	}
+	return nil, nil
+}
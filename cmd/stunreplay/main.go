@@ -0,0 +1,40 @@
+// Command stunreplay decodes STUN messages of a pcap or pcapng capture.
+//
+//	stunreplay capture.pcapng
+//
+// Each decoded message is printed with its addresses. It exits with status 1 on the first message which is not decoded.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pixelbender/go-stun/stun"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: stunreplay capture.pcapng")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	err = stun.Replay(f, stun.HandlerFunc(func(w stun.ResponseWriter, msg *stun.Message) {
+		tr := w.Transport()
+		fmt.Printf("%v → %v %v\n", tr.RemoteAddr(), tr.LocalAddr(), msg)
+	}))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
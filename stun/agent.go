@@ -2,9 +2,11 @@ package stun
 
 import (
 	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,14 +16,15 @@ var DefaultConfig = &Config{
 	Software:              "pixelbender/go-stun",
 }
 
+// Handler responds to a STUN message which is not a response to a pending transaction.
 type Handler interface {
-	ServeSTUN(msg *Message, tr Transport)
+	ServeSTUN(w ResponseWriter, msg *Message)
 }
 
-type HandlerFunc func(msg *Message, tr Transport)
+type HandlerFunc func(w ResponseWriter, msg *Message)
 
-func (h HandlerFunc) ServeSTUN(msg *Message, tr Transport) {
-	h(msg, tr)
+func (h HandlerFunc) ServeSTUN(w ResponseWriter, msg *Message) {
+	h(w, msg)
 }
 
 type Config struct {
@@ -35,8 +38,26 @@ type Config struct {
 	Fingerprint bool
 	// Software is a SOFTWARE attribute value for outgoing messages, if not empty
 	Software string
+	// Strict, if true incoming messages are decoded using Message.UnmarshalStrict and invalid messages are discarded
+	Strict bool
+	// Workers, if positive limits the number of concurrently running handlers
+	Workers int
+	// QueueSize is the number of messages waiting for a free worker, other messages are dropped
+	QueueSize int
+	// Inline, if true handlers are called by the goroutine reading the transport
+	Inline bool
+	// LimitResponseSize, if true responses to unauthenticated requests are not larger than requests.
+	// Optional attributes are omitted to fit, responses which still do not fit are not sent.
+	// XOR-MAPPED-ADDRESS alone is larger than a bare Binding request, so clients have to pad requests, e.g. with PADDING.
+	LimitResponseSize bool
 	// Logf, if set all sent and received messages printed using Logf
 	Logf func(format string, args ...interface{})
+	// Metrics, if set receives events of messages, transactions and handlers
+	Metrics Metrics
+	// Tracer, if set receives raw and parsed messages and transactions with addresses and timing
+	Tracer Tracer
+	// Resolver, if set is used by Dial to discover servers, default is DefaultResolver
+	Resolver Resolver
 }
 
 func (c *Config) attrs() []Attr {
@@ -62,28 +83,57 @@ type Agent struct {
 	config  *Config
 	Handler Handler
 	m       mux
+
+	workers chan struct{}
+	queued  int32
+	dropped uint64
 }
 
 func NewAgent(config *Config) *Agent {
 	if config == nil {
 		config = DefaultConfig
 	}
-	return &Agent{
+	a := &Agent{
 		config: config,
 	}
+	if config.Workers > 0 {
+		a.workers = make(chan struct{}, config.Workers)
+	}
+	return a
+}
+
+// Dropped returns the number of messages dropped because all workers were busy and the queue was full.
+func (a *Agent) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Queued returns the number of messages waiting for a free worker.
+func (a *Agent) Queued() int {
+	return int(atomic.LoadInt32(&a.queued))
 }
 
 func (a *Agent) Send(msg *Message, tr Transport) (err error) {
 	msg = &Message{
-		msg.Type,
-		msg.Transaction,
-		append(a.config.attrs(), msg.Attributes...),
+		Type:        msg.Type,
+		Transaction: msg.Transaction,
+		Attributes:  append(a.config.attrs(), msg.Attributes...),
 	}
+	return a.write(msg, tr)
+}
+
+// write sends the message as is.
+func (a *Agent) write(msg *Message, tr Transport) (err error) {
 	if log := a.config.Logf; log != nil {
 		log("%v → %v %v", tr.LocalAddr(), tr.RemoteAddr(), msg)
 	}
+	if m := a.config.Metrics; m != nil {
+		m.MessageSent(msg)
+	}
 	b := msg.Marshal(getBuffer()[:0])
 	_, err = tr.Write(b)
+	if t := a.config.Tracer; t != nil {
+		t.OnSend(newTraceEvent(tr, b, msg, err))
+	}
 	putBuffer(b)
 	return
 }
@@ -141,36 +191,163 @@ func (a *Agent) ServePacket(c net.PacketConn) error {
 }
 
 func (a *Agent) ServeTransport(b []byte, tr Transport) (n int, err error) {
+	// Messages are passed to handlers and transactions, so they must not refer to the read buffer.
+	if l := messageLen(b); l > 0 {
+		b = append([]byte(nil), b[:l]...)
+	}
 	msg := &Message{}
-	n, err = msg.Unmarshal(b)
+	if a.config.Strict {
+		n, err = msg.UnmarshalStrict(b)
+	} else {
+		n, err = msg.Unmarshal(b)
+	}
+	if t := a.config.Tracer; t != nil && err != io.EOF {
+		if err != nil {
+			t.OnDecodeError(newTraceEvent(tr, b, msg, err))
+		} else {
+			t.OnReceive(newTraceEvent(tr, b[:n], msg, nil))
+		}
+	}
+	if e, ok := err.(*UnknownAttributeError); ok {
+		a.serveUnknown(msg, e, tr)
+		return n, nil
+	}
 	if err != nil {
+		if m := a.config.Metrics; m != nil && err != io.EOF {
+			var typ uint16
+			if e, ok := err.(*errAttribute); ok {
+				typ = e.typ
+			}
+			m.DecodeError(typ, err)
+		}
+		if n > 0 {
+			// Framed but invalid message, discard it.
+			if log := a.config.Logf; log != nil {
+				log("%v ← %v %v: %v", tr.LocalAddr(), tr.RemoteAddr(), msg, err)
+			}
+			return n, nil
+		}
 		return
 	}
 	a.ServeSTUN(msg, tr)
 	return
 }
 
+// serveUnknown answers requests containing unknown comprehension-required attributes with 420 (Unknown Attribute)
+// and fails transactions of such responses. Indications are discarded.
+func (a *Agent) serveUnknown(msg *Message, err *UnknownAttributeError, tr Transport) {
+	if log := a.config.Logf; log != nil {
+		log("%v ← %v %v: %v", tr.LocalAddr(), tr.RemoteAddr(), msg, err)
+	}
+	if m := a.config.Metrics; m != nil {
+		for _, typ := range err.Types {
+			m.DecodeError(typ, err)
+		}
+	}
+	switch msg.Kind() {
+	case KindRequest:
+		if srv, ok := a.Handler.(*Server); ok {
+			// The server answers after its middleware, so filtered or limited clients get no response.
+			msg.unknown = err.Types
+			a.serve(srv, &responseWriter{agent: a, req: msg, tr: tr}, msg)
+			return
+		}
+		types := UnknownAttributes(err.Types)
+		w := &responseWriter{agent: a, req: msg, tr: tr}
+		w.Error(CodeUnknownAttribute, &types)
+	case KindResponse, KindError:
+		a.m.fail(msg, tr, err)
+	}
+}
+
 func (a *Agent) ServeSTUN(msg *Message, tr Transport) {
 	if log := a.config.Logf; log != nil {
 		log("%v ← %v %v", tr.LocalAddr(), tr.RemoteAddr(), msg)
 	}
+	if m := a.config.Metrics; m != nil {
+		m.MessageReceived(msg)
+	}
 	if a.m.serve(msg, tr) {
 		return
 	}
 	if h := a.Handler; h != nil {
-		go h.ServeSTUN(msg, tr)
+		a.serve(h, &responseWriter{agent: a, req: msg, tr: tr}, msg)
 	}
 }
 
+// serve calls the handler inline, in a new goroutine or in a worker if the number of workers is limited.
+func (a *Agent) serve(h Handler, w ResponseWriter, msg *Message) {
+	switch {
+	case a.config.Inline:
+		h.ServeSTUN(w, msg)
+		return
+	case a.workers == nil:
+		go h.ServeSTUN(w, msg)
+		return
+	}
+	select {
+	case a.workers <- struct{}{}:
+		go a.work(h, w, msg)
+		return
+	default:
+	}
+	n := atomic.AddInt32(&a.queued, 1)
+	if int(n) > a.config.QueueSize {
+		atomic.AddInt32(&a.queued, -1)
+		atomic.AddUint64(&a.dropped, 1)
+		if log := a.config.Logf; log != nil {
+			log("%v ← %v %v: dropped, all workers are busy", w.Transport().LocalAddr(), w.Transport().RemoteAddr(), msg)
+		}
+		if m := a.config.Metrics; m != nil {
+			m.MessageDropped(msg)
+		}
+		return
+	}
+	if m := a.config.Metrics; m != nil {
+		m.HandlerQueue(1)
+	}
+	go func() {
+		a.workers <- struct{}{}
+		atomic.AddInt32(&a.queued, -1)
+		if m := a.config.Metrics; m != nil {
+			m.HandlerQueue(-1)
+		}
+		a.work(h, w, msg)
+	}()
+}
+
+func (a *Agent) work(h Handler, w ResponseWriter, msg *Message) {
+	defer func() { <-a.workers }()
+	h.ServeSTUN(w, msg)
+}
+
+// RoundTrip sends the request and waits for the response. It replaces the transaction ID of the request,
+// a classic RFC 3489 transaction ID is used if the request has one.
 func (a *Agent) RoundTrip(req *Message, to Transport) (res *Message, from Transport, err error) {
 	var (
 		start = time.Now()
 		rto   = a.config.RetransmissionTimeout
 		udp   = to.LocalAddr().Network() == "udp"
-		tx    = a.m.newTx()
+		tx    = a.m.newTx(req.Classic())
 	)
 	defer a.m.closeTx(tx)
-	req = &Message{req.Type, tx.id, req.Attributes}
+	req = &Message{Type: req.Type, Transaction: tx.id, Attributes: req.Attributes}
+	if m := a.config.Metrics; m != nil {
+		m.TransactionStarted(req)
+		defer func() {
+			m.TransactionFinished(req, res, time.Since(start), err)
+		}()
+	}
+	if t := a.config.Tracer; t != nil {
+		e := newTraceEvent(to, nil, req, nil)
+		e.Time = start
+		t.OnTransactionStart(e)
+		defer func() {
+			e := newTraceEvent(to, nil, req, err)
+			e.Response, e.RTT = res, time.Since(start)
+			t.OnTransactionEnd(e)
+		}()
+	}
 	if err = a.Send(req, to); err != nil {
 		return
 	}
@@ -186,6 +363,9 @@ func (a *Agent) RoundTrip(req *Message, to Transport) (res *Message, from Transp
 		res, from, err = tx.Receive(d)
 		if udp && err == errTimeout && d == rto {
 			rto <<= 1
+			if m := a.config.Metrics; m != nil {
+				m.Retransmitted(req)
+			}
 			a.Send(req, to)
 			continue
 		}
@@ -203,15 +383,28 @@ func (m *mux) serve(msg *Message, tr Transport) bool {
 	tx, ok := m.t[string(msg.Transaction)]
 	m.RUnlock()
 	if ok {
-		tx.msg, tx.from = msg, tr
-		tx.Done()
+		tx.done(msg, tr, nil)
+		return true
+	}
+	return false
+}
+
+func (m *mux) fail(msg *Message, tr Transport, err error) bool {
+	m.RLock()
+	tx, ok := m.t[string(msg.Transaction)]
+	m.RUnlock()
+	if ok {
+		tx.done(msg, tr, err)
 		return true
 	}
 	return false
 }
 
-func (m *mux) newTx() *transaction {
-	tx := &transaction{id: NewTransaction()}
+func (m *mux) newTx(classic bool) *transaction {
+	tx := &transaction{id: NewTransaction(), ch: make(chan txResult, 1)}
+	if classic {
+		tx.id = NewClassicTransaction()
+	}
 	m.Lock()
 	if m.t == nil {
 		m.t = make(map[string]*transaction)
@@ -240,33 +433,39 @@ func (m *mux) Close() {
 	m.t = nil
 }
 
+// transaction receives the first response. Responses arriving before Receive is called are kept,
+// retransmitted responses are discarded.
 type transaction struct {
-	sync.WaitGroup
-	id   []byte
-	from Transport
+	id []byte
+	ch chan txResult
+}
+
+type txResult struct {
 	msg  *Message
+	from Transport
 	err  error
 }
 
-func (tx *transaction) Receive(d time.Duration) (msg *Message, from Transport, err error) {
-	tx.Add(1)
-	t := time.AfterFunc(d, tx.timeout)
-	tx.Wait()
-	t.Stop()
-	if err = tx.err; err != nil {
-		return
+func (tx *transaction) done(msg *Message, from Transport, err error) {
+	select {
+	case tx.ch <- txResult{msg, from, err}:
+	default:
 	}
-	return tx.msg, tx.from, nil
 }
 
-func (tx *transaction) timeout() {
-	tx.err = errTimeout
-	tx.Done()
+func (tx *transaction) Receive(d time.Duration) (msg *Message, from Transport, err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-tx.ch:
+		return r.msg, r.from, r.err
+	case <-t.C:
+		return nil, nil, errTimeout
+	}
 }
 
 func (tx *transaction) Close() {
-	tx.err = errCanceled
-	tx.Done()
+	tx.done(nil, nil, errCanceled)
 }
 
 var errCanceled = errors.New("stun: transaction canceled")
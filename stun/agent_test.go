@@ -0,0 +1,79 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testTransport struct{}
+
+func (testTransport) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4zero} }
+func (testTransport) RemoteAddr() net.Addr        { return &net.UDPAddr{IP: net.IPv4zero} }
+func (testTransport) Write(p []byte) (int, error) { return len(p), nil }
+func (testTransport) Close() error                { return nil }
+
+func TestAgentWorkers(t *testing.T) {
+	config := DefaultConfig.Clone()
+	config.Workers = 2
+	config.QueueSize = 1
+
+	var (
+		started = make(chan struct{}, 3)
+		release = make(chan struct{})
+		done    = make(chan struct{}, 3)
+	)
+	a := NewAgent(config)
+	a.Handler = HandlerFunc(func(w ResponseWriter, msg *Message) {
+		started <- struct{}{}
+		<-release
+		done <- struct{}{}
+	})
+	for i := 0; i < 4; i++ {
+		a.ServeSTUN(&Message{Type: MethodBinding, Transaction: NewTransaction()}, testTransport{})
+	}
+	<-started
+	<-started
+	if v := a.Queued(); v != 1 {
+		t.Error("wrong queue length:", v)
+	}
+	if v := a.Dropped(); v != 1 {
+		t.Error("wrong number of dropped messages:", v)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+}
+
+func TestAgentInline(t *testing.T) {
+	config := DefaultConfig.Clone()
+	config.Inline = true
+
+	n := 0
+	a := NewAgent(config)
+	a.Handler = HandlerFunc(func(w ResponseWriter, msg *Message) {
+		n++
+	})
+	a.ServeSTUN(&Message{Type: MethodBinding, Transaction: NewTransaction()}, testTransport{})
+	if n != 1 {
+		t.Error("handler is not called inline")
+	}
+}
+
+func TestTransactionEarlyResponse(t *testing.T) {
+	var m mux
+	tx := m.newTx(false)
+	defer m.closeTx(tx)
+	msg := &Message{Type: MethodBinding | KindResponse, Transaction: tx.id}
+	// A response arriving before Receive and its retransmission
+	m.serve(msg, nil)
+	m.serve(msg, nil)
+	res, _, err := tx.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != msg {
+		t.Error("wrong response")
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 // Attribute represents a STUN attribute.
@@ -29,32 +32,75 @@ const (
 	ChangePort        = 0x02
 )
 
+// Attributes of RFC 8656. They are skipped by gen.go, so regenerating registry.go does not duplicate them.
+const (
+	AttrAdditionalAddressFamily uint16 = 0x8000
+	AttrAddressErrorCode        uint16 = 0x8001
+)
+
+func init() {
+	attrNames[AttrAdditionalAddressFamily] = "ADDITIONAL-ADDRESS-FAMILY"
+	attrNames[AttrAddressErrorCode] = "ADDRESS-ERROR-CODE"
+}
+
+// AttrFactory returns a new empty attribute to decode into.
+type AttrFactory func() Attr
+
+var registry = struct {
+	sync.RWMutex
+	factories map[uint16]AttrFactory
+}{factories: make(map[uint16]AttrFactory)}
+
+// RegisterAttr registers a factory and a name for the attribute type.
+// Registered attributes are decoded by Message.Unmarshal and printed by Message.String.
+// It overrides the built-in decoder of the type. A nil factory registers the name only.
+func RegisterAttr(typ uint16, factory AttrFactory, name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	if factory != nil {
+		registry.factories[typ] = factory
+	}
+	if name != "" {
+		attrNames[typ] = name
+	}
+}
+
 func newAttr(typ uint16) Attr {
+	registry.RLock()
+	f := registry.factories[typ]
+	registry.RUnlock()
+	if f != nil {
+		return f()
+	}
 	switch typ {
 	case AttrMappedAddress, AttrXorPeerAddress, AttrXorRelayedAddress,
 		AttrXorMappedAddress, AttrAlternateServer, AttrResponseOrigin, AttrOtherAddress,
 		AttrResponseAddress, AttrSourceAddress, AttrChangedAddress, AttrReflectedFrom:
-		return &addr{typ: typ}
-	case AttrRequestedAddressFamily, AttrRequestedTransport:
-		return &number{typ: typ, size: 4, pad: 24}
+		return &Address{typ: typ}
+	case AttrRequestedAddressFamily, AttrAdditionalAddressFamily, AttrRequestedTransport:
+		return &Number{typ: typ, size: 4, pad: 24}
 	case AttrChannelNumber, AttrResponsePort:
-		return &number{typ: typ, size: 4, pad: 16}
+		return &Number{typ: typ, size: 4, pad: 16}
 	case AttrLifetime, AttrConnectionID, AttrCacheTimeout,
 		AttrBandwidth, AttrTimerVal,
 		AttrTransactionTransmitCounter,
 		AttrEcnCheck, AttrChangeRequest, AttrPriority:
-		return &number{typ: typ, size: 4}
+		return &Number{typ: typ, size: 4}
 	case AttrIceControlled, AttrIceControlling:
-		return &number{typ: typ, size: 8}
+		return &Number{typ: typ, size: 8}
 	case AttrUsername, AttrRealm, AttrNonce, AttrSoftware, AttrPassword, AttrThirdPartyAuthorization,
-		AttrData, AttrAccessToken, AttrReservationToken, AttrMobilityTicket, AttrPadding, AttrUnknownAttributes:
-		return &raw{typ: typ}
+		AttrData, AttrAccessToken, AttrReservationToken, AttrMobilityTicket, AttrPadding:
+		return &Raw{typ: typ}
+	case AttrUnknownAttributes:
+		return &UnknownAttributes{}
 	case AttrMessageIntegrity:
 		return &integrity{}
 	case AttrErrorCode:
 		return &Error{}
+	case AttrAddressErrorCode:
+		return &AddressError{}
 	case AttrEvenPort:
-		return &number{typ: typ, size: 1}
+		return &Number{typ: typ, size: 1}
 	case AttrDontFragment, AttrUseCandidate:
 		return flag(typ)
 	case AttrFingerprint:
@@ -64,7 +110,10 @@ func newAttr(typ uint16) Attr {
 }
 
 func AttrName(typ uint16) string {
-	if r, ok := attrNames[typ]; ok {
+	registry.RLock()
+	r, ok := attrNames[typ]
+	registry.RUnlock()
+	if ok {
 		return r
 	}
 	return "0x" + strconv.FormatUint(uint64(typ), 16)
@@ -72,57 +121,58 @@ func AttrName(typ uint16) string {
 
 func Int(typ uint16, v uint64) Attr {
 	switch typ {
-	case AttrRequestedAddressFamily, AttrRequestedTransport:
-		return &number{typ, 4, 24, v}
+	case AttrRequestedAddressFamily, AttrAdditionalAddressFamily, AttrRequestedTransport:
+		return &Number{typ, 4, 24, v}
 	case AttrChannelNumber, AttrResponsePort:
-		return &number{typ, 4, 16, v}
+		return &Number{typ, 4, 16, v}
 	case AttrIceControlled, AttrIceControlling:
-		return &number{typ, 8, 0, v}
+		return &Number{typ, 8, 0, v}
 	case AttrEvenPort:
-		return &number{typ, 1, 0, v}
+		return &Number{typ, 1, 0, v}
 	default:
-		return &number{typ, 4, 0, v}
+		return &Number{typ, 4, 0, v}
 	}
 }
 
-type number struct {
+// Number represents an integer attribute such as LIFETIME, PRIORITY or CHANGE-REQUEST.
+type Number struct {
 	typ       uint16
 	size, pad uint8
-	v         uint64
+	Value     uint64
 }
 
-func (a *number) Type() uint16 { return a.typ }
+func (a *Number) Type() uint16 { return a.typ }
 
-func (a *number) Marshal(p []byte) []byte {
+func (a *Number) Marshal(p []byte) []byte {
 	r, b := grow(p, int(a.size))
 	switch a.size {
 	case 1:
-		b[0] = byte(a.v)
+		b[0] = byte(a.Value)
 	case 4:
-		be.PutUint32(b, uint32(a.v<<a.pad))
+		be.PutUint32(b, uint32(a.Value<<a.pad))
 	case 8:
-		be.PutUint64(b, a.v<<a.pad)
+		be.PutUint64(b, a.Value<<a.pad)
 	}
 	return r
 }
 
-func (a *number) Unmarshal(b []byte) error {
+func (a *Number) Unmarshal(b []byte) error {
 	if len(b) < int(a.size) {
 		return errFormat
 	}
 	switch a.size {
 	case 1:
-		a.v = uint64(b[0])
+		a.Value = uint64(b[0])
 	case 4:
-		a.v = uint64(be.Uint32(b) >> a.pad)
+		a.Value = uint64(be.Uint32(b) >> a.pad)
 	case 8:
-		a.v = be.Uint64(b) >> a.pad
+		a.Value = be.Uint64(b) >> a.pad
 	}
 	return nil
 }
 
-func (a *number) String() string {
-	return "0x" + strconv.FormatUint(a.v, 16)
+func (a *Number) String() string {
+	return "0x" + strconv.FormatUint(a.Value, 16)
 }
 
 func Flag(v uint16) Attr {
@@ -169,11 +219,88 @@ func (e *Error) Unmarshal(b []byte) error {
 func (e *Error) Error() string  { return e.String() }
 func (e *Error) String() string { return fmt.Sprintf("%d %s", e.Code, e.Reason) }
 
+// ErrorCode is an alias of Error named after the ERROR-CODE attribute.
+type ErrorCode = Error
+
+// AddressError represents the ADDRESS-ERROR-CODE attribute.
+// It reports why a relayed address of the family was not allocated, e.g. for a dual allocation.
+type AddressError struct {
+	Family byte
+	Error
+}
+
+func NewAddressError(family byte, code int) *AddressError {
+	return &AddressError{family, Error{code, ErrorText(code)}}
+}
+
+func (*AddressError) Type() uint16 { return AttrAddressErrorCode }
+
+func (e *AddressError) Marshal(p []byte) []byte {
+	r := e.Error.Marshal(p)
+	r[len(p)] = e.Family
+	return r
+}
+
+func (e *AddressError) Unmarshal(b []byte) error {
+	if err := e.Error.Unmarshal(b); err != nil {
+		return err
+	}
+	e.Family = b[0]
+	return nil
+}
+
+func (e *AddressError) String() string {
+	return fmt.Sprintf("%s %d %s", familyName(e.Family), e.Code, e.Reason)
+}
+
+func familyName(family byte) string {
+	switch family {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	}
+	return "0x" + strconv.FormatUint(uint64(family), 16)
+}
+
+// UnknownAttributes represents the UNKNOWN-ATTRIBUTES attribute.
+type UnknownAttributes []uint16
+
+func (*UnknownAttributes) Type() uint16 { return AttrUnknownAttributes }
+
+func (a *UnknownAttributes) Marshal(p []byte) []byte {
+	r, b := grow(p, len(*a)<<1)
+	for i, it := range *a {
+		be.PutUint16(b[i<<1:], it)
+	}
+	return r
+}
+
+func (a *UnknownAttributes) Unmarshal(b []byte) error {
+	if len(b)&1 != 0 {
+		return errFormat
+	}
+	r := (*a)[:0]
+	for i := 0; i < len(b); i += 2 {
+		r = append(r, be.Uint16(b[i:]))
+	}
+	*a = r
+	return nil
+}
+
+func (a *UnknownAttributes) String() string {
+	b := make([]string, len(*a))
+	for i, it := range *a {
+		b[i] = AttrName(it)
+	}
+	return "[" + strings.Join(b, " ") + "]"
+}
+
 // ErrorText returns a text for the STUN error code. It returns the empty string if the code is unknown.
 func ErrorText(code int) string { return errorText[code] }
 
 func getString(b []byte) string {
-	for i := len(b); i >= 0; i-- {
+	for i := len(b); i > 0; i-- {
 		if b[i-1] > 0 {
 			return string(b[:i])
 		}
@@ -183,7 +310,7 @@ func getString(b []byte) string {
 
 func Addr(typ uint16, v net.Addr) Attr {
 	ip, port := SockAddr(v)
-	return &addr{typ, ip, port}
+	return &Address{typ: typ, IP: ip, Port: port}
 }
 
 func SockAddr(v net.Addr) (net.IP, int) {
@@ -215,21 +342,28 @@ func NewAddr(network string, ip net.IP, port int) net.Addr {
 	return &net.IPAddr{IP: ip}
 }
 
-func IP(typ uint16, ip net.IP) Attr { return &addr{typ, ip, 0} }
+func IP(typ uint16, ip net.IP) Attr { return &Address{typ: typ, IP: ip} }
+
+// NewAddress returns an address attribute of the given type.
+func NewAddress(typ uint16, ip net.IP, port int) *Address {
+	return &Address{typ: typ, IP: ip, Port: port}
+}
 
-type addr struct {
+// Address represents an address attribute such as MAPPED-ADDRESS or XOR-MAPPED-ADDRESS.
+type Address struct {
 	typ  uint16
 	IP   net.IP
 	Port int
+	buf  [net.IPv6len]byte
 }
 
-func (addr *addr) Type() uint16 { return addr.typ }
+func (addr *Address) Type() uint16 { return addr.typ }
 
-func (addr *addr) Addr(network string) net.Addr {
+func (addr *Address) Addr(network string) net.Addr {
 	return NewAddr(network, addr.IP, addr.Port)
 }
 
-func (addr *addr) Xored() bool {
+func (addr *Address) Xored() bool {
 	switch addr.typ {
 	case AttrXorMappedAddress, AttrXorPeerAddress, AttrXorRelayedAddress:
 		return true
@@ -238,11 +372,11 @@ func (addr *addr) Xored() bool {
 	}
 }
 
-func (addr *addr) Marshal(p []byte) []byte {
+func (addr *Address) Marshal(p []byte) []byte {
 	return addr.MarshalAddr(p, nil)
 }
 
-func (addr *addr) MarshalAddr(p, tx []byte) []byte {
+func (addr *Address) MarshalAddr(p, tx []byte) []byte {
 	fam, ip := IPv4, addr.IP.To4()
 	if ip == nil {
 		fam, ip = IPv6, addr.IP
@@ -263,11 +397,11 @@ func (addr *addr) MarshalAddr(p, tx []byte) []byte {
 	return r
 }
 
-func (addr *addr) Unmarshal(b []byte) error {
+func (addr *Address) Unmarshal(b []byte) error {
 	return addr.UnmarshalAddr(b, nil)
 }
 
-func (addr *addr) UnmarshalAddr(b, tx []byte) error {
+func (addr *Address) UnmarshalAddr(b, tx []byte) error {
 	if len(b) < 4 {
 		return errFormat
 	}
@@ -278,10 +412,10 @@ func (addr *addr) UnmarshalAddr(b, tx []byte) error {
 	if b = b[4:]; len(b) < n {
 		return errFormat
 	}
-	addr.IP = make(net.IP, n)
+	addr.IP = addr.buf[:n]
 	if addr.Xored() && tx != nil {
-		for i, it := range b {
-			addr.IP[i] = it ^ tx[i]
+		for i := range addr.IP {
+			addr.IP[i] = b[i] ^ tx[i]
 		}
 		addr.Port = port ^ 0x2112
 	} else {
@@ -291,55 +425,64 @@ func (addr *addr) UnmarshalAddr(b, tx []byte) error {
 	return nil
 }
 
-func (addr *addr) Equal(a *addr) bool {
+func (addr *Address) Equal(a *Address) bool {
 	return addr == a || (addr != nil && a != nil && addr.IP.Equal(a.IP) && addr.Port == a.Port)
 }
 
-func (addr *addr) String() string {
+func (addr *Address) String() string {
 	if addr.Port == 0 {
 		return addr.IP.String()
 	}
 	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
 }
 
-func Bytes(typ uint16, v []byte) Attr { return &raw{typ, v} }
+func Bytes(typ uint16, v []byte) Attr { return &Raw{typ, v} }
 
-type raw struct {
+// Padding returns the PADDING attribute of n zero bytes.
+func Padding(n int) Attr { return &Raw{AttrPadding, make([]byte, n)} }
+
+// Raw represents an opaque attribute such as DATA, NONCE or PADDING.
+type Raw struct {
 	typ  uint16
-	data []byte
+	Data []byte
 }
 
-func (attr *raw) Type() uint16            { return attr.typ }
-func (attr *raw) Marshal(p []byte) []byte { return append(p, attr.data...) }
-func (attr *raw) Unmarshal(p []byte) error {
-	attr.data = p
+func (attr *Raw) Type() uint16            { return attr.typ }
+func (attr *Raw) Marshal(p []byte) []byte { return append(p, attr.Data...) }
+func (attr *Raw) Unmarshal(p []byte) error {
+	attr.Data = p
 	return nil
 }
-func (attr *raw) String() string { return string(attr.data) }
+func (attr *Raw) String() string { return string(attr.Data) }
 
 func String(typ uint16, v string) Attr {
-	return &str{typ, v}
+	return &Text{typ, v}
 }
 
-type str struct {
-	typ  uint16
-	data string
+// Text represents a textual attribute such as USERNAME, REALM or SOFTWARE.
+type Text struct {
+	typ   uint16
+	Value string
 }
 
-func (attr *str) Type() uint16            { return attr.typ }
-func (attr *str) Marshal(p []byte) []byte { return append(p, attr.data...) }
-func (attr *str) Unmarshal(p []byte) error {
-	attr.data = string(p)
+func (attr *Text) Type() uint16            { return attr.typ }
+func (attr *Text) Marshal(p []byte) []byte { return append(p, attr.Value...) }
+func (attr *Text) Unmarshal(p []byte) error {
+	attr.Value = string(p)
 	return nil
 }
-func (attr *str) String() string { return attr.data }
+func (attr *Text) String() string { return attr.Value }
 
+// MessageIntegrity returns the MESSAGE-INTEGRITY attribute.
+// The attribute keeps HMAC state, so it must not be shared between messages marshaled concurrently.
 func MessageIntegrity(key []byte) Attr {
 	return &integrity{key: key}
 }
 
 type integrity struct {
 	key, sum, raw []byte
+	h             hash.Hash
+	hkey          []byte
 }
 
 func (*integrity) Type() uint16 {
@@ -370,9 +513,13 @@ func (attr *integrity) UnmarshalSum(p, raw []byte) error {
 }
 
 func (attr *integrity) Sum(key, data, p []byte) []byte {
-	h := hmac.New(sha1.New, key)
-	h.Write(data)
-	return h.Sum(p)
+	if attr.h == nil || !bytes.Equal(attr.hkey, key) {
+		attr.h, attr.hkey = hmac.New(sha1.New, key), key
+	} else {
+		attr.h.Reset()
+	}
+	attr.h.Write(data)
+	return attr.h.Sum(p)
 }
 
 func (attr *integrity) Check(key []byte) bool {
@@ -380,9 +527,14 @@ func (attr *integrity) Check(key []byte) bool {
 	if len(r) < 44 {
 		return r == nil
 	}
-	be.PutUint16(r[2:], uint16(len(r)-20))
-	h := attr.Sum(key, r[:len(r)-24], nil)
-	return bytes.Equal(h, attr.sum)
+	// The message refers to the read buffer, so the length is hashed separately rather than patched.
+	var l [2]byte
+	be.PutUint16(l[:], uint16(len(r)-20))
+	h := hmac.New(sha1.New, key)
+	h.Write(r[:2])
+	h.Write(l[:])
+	h.Write(r[4 : len(r)-24])
+	return hmac.Equal(h.Sum(nil), attr.sum)
 }
 
 var Fingerprint Attr = &fingerprint{}
@@ -433,6 +585,9 @@ func (attr *fingerprint) Check() bool {
 	if len(r) < 28 {
 		return r == nil
 	}
-	be.PutUint16(r[2:], uint16(len(r)-20))
-	return attr.Sum(r[:len(r)-8]) == attr.sum
+	var l [2]byte
+	be.PutUint16(l[:], uint16(len(r)-20))
+	v := crc32.Update(crc32.ChecksumIEEE(r[:2]), crc32.IEEETable, l[:])
+	v = crc32.Update(v, crc32.IEEETable, r[4:len(r)-8])
+	return v^0x5354554e == attr.sum
 }
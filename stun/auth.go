@@ -0,0 +1,84 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// NonceTimeout is the lifetime of nonces issued by LongTermAuth.
+var NonceTimeout = 10 * time.Minute
+
+// LongTermAuth returns a middleware which authenticates requests using long-term credentials
+// as defined in RFC 5389 section 10.2. The password function returns the password of the user.
+// Requests without valid MESSAGE-INTEGRITY are answered with 401 (Unauthorized) and expired nonces with 438 (Stale Nonce).
+// Authenticated requests are passed with the session set, so responses have MESSAGE-INTEGRITY.
+// Indications are discarded unless authenticated.
+func LongTermAuth(realm string, password func(username string) (string, bool)) Middleware {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, msg *Message) {
+			req := msg.Kind() == KindRequest
+			challenge := func(code int) {
+				if req {
+					w.Error(code, String(AttrRealm, realm), String(AttrNonce, newNonce(secret, time.Now())))
+				}
+			}
+			if !msg.Has(AttrMessageIntegrity) {
+				challenge(CodeUnauthorized)
+				return
+			}
+			username, nonce := msg.GetString(AttrUsername), msg.GetString(AttrNonce)
+			if username == "" || nonce == "" || msg.GetString(AttrRealm) == "" {
+				if req {
+					w.Error(CodeBadRequest)
+				}
+				return
+			}
+			if !checkNonce(secret, nonce, time.Now()) {
+				challenge(CodeStaleNonce)
+				return
+			}
+			pass, ok := password(username)
+			if !ok {
+				challenge(CodeUnauthorized)
+				return
+			}
+			sess := &Session{Realm: realm, Nonce: nonce}
+			LongTermAuthMethod(username, pass)(sess)
+			if !msg.CheckIntegrity(sess.Key) {
+				challenge(CodeUnauthorized)
+				return
+			}
+			w.SetSession(sess)
+			h.ServeSTUN(w, msg)
+		})
+	}
+}
+
+// newNonce returns a nonce containing the issue time signed with the secret, so it is checked without state.
+func newNonce(secret []byte, t time.Time) string {
+	b := make([]byte, 8, 28)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	m := hmac.New(sha1.New, secret)
+	m.Write(b)
+	return hex.EncodeToString(m.Sum(b))
+}
+
+func checkNonce(secret []byte, nonce string, now time.Time) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 28 {
+		return false
+	}
+	m := hmac.New(sha1.New, secret)
+	m.Write(b[:8])
+	if !hmac.Equal(m.Sum(nil), b[8:]) {
+		return false
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	return now.Sub(t) < NonceTimeout
+}
@@ -0,0 +1,59 @@
+package stun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLongTermAuth(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	srv.Use(LongTermAuth("example.org", func(username string) (string, bool) {
+		return "secret", username == "user"
+	}))
+	_, addr := newTestServer(t, srv)
+	for _, it := range []struct {
+		auth AuthMethod
+		code int
+	}{
+		{LongTermAuthMethod("user", "secret"), 0},
+		{LongTermAuthMethod("user", "wrong"), CodeUnauthorized},
+		{LongTermAuthMethod("other", "secret"), CodeUnauthorized},
+		{nil, CodeUnauthorized},
+	} {
+		config := DefaultConfig.Clone()
+		config.AuthMethod = it.auth
+		conn, err := Dial("stun:"+addr.String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.Request(&Message{Type: MethodBinding})
+		conn.Close()
+		if it.code == 0 {
+			if err != nil {
+				t.Error(err)
+			} else if !res.Has(AttrMessageIntegrity) {
+				t.Error("no message integrity")
+			}
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.Code != it.code {
+			t.Errorf("unexpected error: %v, expected %d", err, it.code)
+		}
+	}
+}
+
+func TestNonce(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	nonce := newNonce(secret, now)
+	if !checkNonce(secret, nonce, now) {
+		t.Error("valid nonce is not accepted")
+	}
+	if checkNonce(secret, nonce, now.Add(NonceTimeout)) {
+		t.Error("stale nonce is accepted")
+	}
+	if checkNonce([]byte("other"), nonce, now) {
+		t.Error("forged nonce is accepted")
+	}
+}
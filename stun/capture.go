@@ -0,0 +1,526 @@
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CapturedPacket is a UDP datagram of a capture.
+type CapturedPacket struct {
+	Time time.Time
+	Src  *net.UDPAddr
+	Dst  *net.UDPAddr
+	Data []byte
+}
+
+// CaptureWriter writes sent and received messages to a pcapng file with synthesized IP and UDP headers.
+// It is a Tracer, so it may be set as Config.Tracer of an agent.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	b   []byte
+	err error
+}
+
+const (
+	blockSection   = 0x0a0d0d0a
+	blockInterface = 0x00000001
+	blockSimple    = 0x00000003
+	blockEnhanced  = 0x00000006
+
+	byteOrderMagic uint32 = 0x1a2b3c4d
+
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+)
+
+var le = binary.LittleEndian
+
+// NewCaptureWriter writes the pcapng section header and returns a writer of packets.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	c := &CaptureWriter{w: w}
+	b := c.block(blockSection, 16)
+	le.PutUint32(b[8:], byteOrderMagic)
+	le.PutUint16(b[12:], 1)
+	le.PutUint64(b[16:], ^uint64(0))
+	b = c.block(blockInterface, 8)
+	le.PutUint16(b[8:], linkRaw)
+	if _, err := w.Write(c.b); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// block appends a block of the given body size to the buffer and returns it.
+func (c *CaptureWriter) block(typ uint32, size int) []byte {
+	n := 12 + (size+3)&^3
+	var b []byte
+	c.b, b = grow(c.b, n)
+	for i := range b {
+		b[i] = 0
+	}
+	le.PutUint32(b, typ)
+	le.PutUint32(b[4:], uint32(n))
+	le.PutUint32(b[n-4:], uint32(n))
+	return b
+}
+
+// WritePacket writes the packet with synthesized IPv4 or IPv6 and UDP headers.
+func (c *CaptureWriter) WritePacket(p *CapturedPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	src, dst := p.Src.IP.To4(), p.Dst.IP.To4()
+	ip := 20
+	if src == nil || dst == nil {
+		src, dst, ip = p.Src.IP.To16(), p.Dst.IP.To16(), 40
+		if src == nil {
+			src = net.IPv6zero
+		}
+		if dst == nil {
+			dst = net.IPv6zero
+		}
+	}
+	size := ip + 8 + len(p.Data)
+	c.b = c.b[:0]
+	b := c.block(blockEnhanced, 20+size)
+	ts := uint64(p.Time.UnixNano() / 1000)
+	le.PutUint32(b[12:], uint32(ts>>32))
+	le.PutUint32(b[16:], uint32(ts))
+	le.PutUint32(b[20:], uint32(size))
+	le.PutUint32(b[24:], uint32(size))
+	b = b[28 : 28+size]
+	if ip == 20 {
+		b[0] = 0x45
+		be.PutUint16(b[2:], uint16(size))
+		b[8], b[9] = 64, 17
+		copy(b[12:], src)
+		copy(b[16:], dst)
+		be.PutUint16(b[10:], ^fold(sum(0, b[:20])))
+	} else {
+		b[0] = 0x60
+		be.PutUint16(b[4:], uint16(size-40))
+		b[6], b[7] = 17, 64
+		copy(b[8:], src)
+		copy(b[24:], dst)
+	}
+	u := b[ip:]
+	be.PutUint16(u, uint16(p.Src.Port))
+	be.PutUint16(u[2:], uint16(p.Dst.Port))
+	be.PutUint16(u[4:], uint16(len(u)))
+	copy(u[8:], p.Data)
+	// Pseudo header checksum
+	if s := ^fold(sum(sum(sum(17+uint32(len(u)), src), dst), u)); s != 0 {
+		be.PutUint16(u[6:], s)
+	} else {
+		be.PutUint16(u[6:], 0xffff)
+	}
+	_, c.err = c.w.Write(c.b)
+	return c.err
+}
+
+// Err returns the first error of writing traced messages.
+func (c *CaptureWriter) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *CaptureWriter) OnSend(e *TraceEvent) {
+	c.trace(e.LocalAddr, e.RemoteAddr, e)
+}
+
+func (c *CaptureWriter) OnReceive(e *TraceEvent) {
+	c.trace(e.RemoteAddr, e.LocalAddr, e)
+}
+
+func (c *CaptureWriter) OnDecodeError(e *TraceEvent) {
+	c.trace(e.RemoteAddr, e.LocalAddr, e)
+}
+
+func (c *CaptureWriter) OnTransactionStart(e *TraceEvent) {}
+
+func (c *CaptureWriter) OnTransactionEnd(e *TraceEvent) {}
+
+func (c *CaptureWriter) trace(src, dst net.Addr, e *TraceEvent) {
+	if e.Data != nil {
+		c.WritePacket(&CapturedPacket{Time: e.Time, Src: udpAddr(src), Dst: udpAddr(dst), Data: e.Data})
+	}
+}
+
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	case *net.IPAddr:
+		return &net.UDPAddr{IP: a.IP}
+	}
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+// sum adds 16-bit words of b for the internet checksum.
+func sum(s uint32, b []byte) uint32 {
+	for ; len(b) > 1; b = b[2:] {
+		s += uint32(be.Uint16(b))
+	}
+	if len(b) > 0 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// CaptureReader reads UDP datagrams from a pcap or pcapng file.
+type CaptureReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	ng    bool
+	links []captureLink
+}
+
+type captureLink struct {
+	typ uint16
+	// ticks is the number of timestamp units per second
+	ticks uint64
+}
+
+var errCaptureFormat = errors.New("stun: unsupported capture format")
+
+// maxBlockSize limits the size of capture records.
+const maxBlockSize = 1 << 20
+
+// NewCaptureReader reads the pcap file header or the first pcapng section header.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{r: r}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if le.Uint32(b) == blockSection {
+		c.ng = true
+		if err := c.readSection(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	var ticks uint64
+	switch magic := le.Uint32(b); magic {
+	case 0xa1b2c3d4, 0xd4c3b2a1:
+		ticks = 1e6
+	case 0xa1b23c4d, 0x4d3cb2a1:
+		ticks = 1e9
+	default:
+		return nil, errCaptureFormat
+	}
+	if b[0] == 0xa1 {
+		c.order = binary.BigEndian
+	} else {
+		c.order = binary.LittleEndian
+	}
+	b = make([]byte, 20)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	c.links = []captureLink{{uint16(c.order.Uint32(b[16:])), ticks}}
+	return c, nil
+}
+
+// readSection reads the section header block after the block type.
+func (c *CaptureReader) readSection() error {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return err
+	}
+	switch byteOrderMagic {
+	case le.Uint32(b[4:]):
+		c.order = binary.LittleEndian
+	case be.Uint32(b[4:]):
+		c.order = binary.BigEndian
+	default:
+		return errCaptureFormat
+	}
+	n := int(c.order.Uint32(b))
+	if n < 28 || n%4 != 0 || n > maxBlockSize {
+		return errFormat
+	}
+	c.links = nil
+	_, err := io.ReadFull(c.r, make([]byte, n-12))
+	return err
+}
+
+// ReadPacket returns the next UDP datagram. Other packets are skipped. It returns io.EOF at the end of the capture.
+func (c *CaptureReader) ReadPacket() (*CapturedPacket, error) {
+	for {
+		link, ts, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if link == nil {
+			continue
+		}
+		p, ok := parseDatagram(link.typ, data)
+		if !ok {
+			continue
+		}
+		sec, frac := ts/link.ticks, ts%link.ticks
+		p.Time = time.Unix(int64(sec), int64(float64(frac)*1e9/float64(link.ticks)))
+		return p, nil
+	}
+}
+
+// readRecord reads the next packet record or block, link is nil for blocks without packets.
+func (c *CaptureReader) readRecord() (link *captureLink, ts uint64, data []byte, err error) {
+	if !c.ng {
+		b := make([]byte, 16)
+		if _, err = io.ReadFull(c.r, b); err != nil {
+			return
+		}
+		n := c.order.Uint32(b[8:])
+		if n > maxBlockSize {
+			err = errFormat
+			return
+		}
+		data = make([]byte, n)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, 0, nil, noEOF(err)
+		}
+		link = &c.links[0]
+		ts = uint64(c.order.Uint32(b))*link.ticks + uint64(c.order.Uint32(b[4:]))
+		return
+	}
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(c.r, b[:4]); err != nil {
+		return
+	}
+	typ := c.order.Uint32(b)
+	if typ == blockSection {
+		err = noEOF(c.readSection())
+		return
+	}
+	if _, err = io.ReadFull(c.r, b[4:]); err != nil {
+		return nil, 0, nil, noEOF(err)
+	}
+	n := int(c.order.Uint32(b[4:]))
+	if n < 12 || n%4 != 0 || n > maxBlockSize {
+		err = errFormat
+		return
+	}
+	body := make([]byte, n-8)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		return nil, 0, nil, noEOF(err)
+	}
+	body = body[:n-12]
+	switch typ {
+	case blockInterface:
+		if len(body) < 8 {
+			err = errFormat
+			return
+		}
+		c.links = append(c.links, captureLink{c.order.Uint16(body), interfaceTicks(c.order, body[8:])})
+	case blockEnhanced:
+		if len(body) < 20 {
+			err = errFormat
+			return
+		}
+		i, l := int(c.order.Uint32(body)), int(c.order.Uint32(body[12:]))
+		if i >= len(c.links) || 20+l > len(body) {
+			err = errFormat
+			return
+		}
+		link = &c.links[i]
+		ts = uint64(c.order.Uint32(body[4:]))<<32 | uint64(c.order.Uint32(body[8:]))
+		data = body[20 : 20+l]
+	case blockSimple:
+		if len(body) < 4 || len(c.links) == 0 {
+			err = errFormat
+			return
+		}
+		l := int(c.order.Uint32(body))
+		if 4+l > len(body) {
+			l = len(body) - 4
+		}
+		link, data = &c.links[0], body[4:4+l]
+	}
+	return
+}
+
+// interfaceTicks returns the timestamp resolution of the interface description block options.
+func interfaceTicks(order binary.ByteOrder, b []byte) uint64 {
+	for len(b) >= 4 {
+		code, l := order.Uint16(b), int(order.Uint16(b[2:]))
+		if 4+l > len(b) || code == 0 {
+			break
+		}
+		if code == 9 && l == 1 {
+			// if_tsresol
+			r, ticks := b[4], uint64(1)
+			if r&0x80 != 0 {
+				return ticks << (r & 0x7f)
+			}
+			for ; r > 0; r-- {
+				ticks *= 10
+			}
+			return ticks
+		}
+		b = b[4+(l+3)&^3:]
+	}
+	return 1e6
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseDatagram strips link, IP and UDP headers of the captured frame.
+func parseDatagram(link uint16, b []byte) (*CapturedPacket, bool) {
+	switch link {
+	case linkRaw, linkIPv4, linkIPv6:
+	case linkNull, linkLoop:
+		if len(b) < 4 {
+			return nil, false
+		}
+		b = b[4:]
+	case linkEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		typ, b := be.Uint16(b[12:]), b[14:]
+		for typ == 0x8100 && len(b) >= 4 {
+			typ, b = be.Uint16(b[2:]), b[4:]
+		}
+		if typ != 0x0800 && typ != 0x86dd {
+			return nil, false
+		}
+		return parseIP(b)
+	case linkSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		b = b[16:]
+	default:
+		return nil, false
+	}
+	return parseIP(b)
+}
+
+func parseIP(b []byte) (*CapturedPacket, bool) {
+	var src, dst net.IP
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		h := int(b[0]&0xf) * 4
+		if h < 20 || len(b) < h || b[9] != 17 || be.Uint16(b[6:])&0x3fff != 0 {
+			// Not UDP or a fragment
+			return nil, false
+		}
+		if l := int(be.Uint16(b[2:])); l >= h && l < len(b) {
+			b = b[:l]
+		}
+		src, dst, b = net.IP(b[12:16]), net.IP(b[16:20]), b[h:]
+	case len(b) >= 40 && b[0]>>4 == 6:
+		if b[6] != 17 {
+			return nil, false
+		}
+		src, dst, b = net.IP(b[8:24]), net.IP(b[24:40]), b[40:]
+	default:
+		return nil, false
+	}
+	if len(b) < 8 {
+		return nil, false
+	}
+	if l := int(be.Uint16(b[4:])); l >= 8 && l < len(b) {
+		b = b[:l]
+	}
+	return &CapturedPacket{
+		Src:  &net.UDPAddr{IP: src, Port: int(be.Uint16(b))},
+		Dst:  &net.UDPAddr{IP: dst, Port: int(be.Uint16(b[2:]))},
+		Data: b[8:],
+	}, true
+}
+
+// Replay decodes messages of the capture using Message.Unmarshal and passes them to the handler.
+// Responses of the handler are discarded. Datagrams which are not STUN messages are skipped.
+// It returns a *ReplayError if a message is not decoded.
+func Replay(r io.Reader, h Handler) error {
+	c, err := NewCaptureReader(r)
+	if err != nil {
+		return err
+	}
+	a := NewAgent(&Config{Inline: true})
+	for i := 1; ; i++ {
+		p, err := c.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(p.Data) < 20 || p.Data[0]&0xc0 != 0 {
+			continue
+		}
+		msg := &Message{}
+		if _, err = msg.Unmarshal(p.Data); err != nil {
+			return &ReplayError{i, p, err}
+		}
+		h.ServeSTUN(&responseWriter{agent: a, req: msg, tr: replayTransport{p}}, msg)
+	}
+}
+
+// ReplayError is an error of decoding a captured message.
+type ReplayError struct {
+	// Index is the number of the datagram in the capture, starting from 1
+	Index  int
+	Packet *CapturedPacket
+	Err    error
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("stun: datagram %d %v → %v: %v", e.Index, e.Packet.Src, e.Packet.Dst, e.Err)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Err
+}
+
+// replayTransport discards responses to captured messages.
+type replayTransport struct {
+	p *CapturedPacket
+}
+
+func (t replayTransport) LocalAddr() net.Addr {
+	return t.p.Dst
+}
+
+func (t replayTransport) RemoteAddr() net.Addr {
+	return t.p.Src
+}
+
+func (t replayTransport) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (t replayTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	_, addr := newTestServer(t, srv)
+	b := &bytes.Buffer{}
+	c, err := NewCaptureWriter(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig.Clone()
+	config.Tracer = c
+	conn, err := Dial("stun:"+addr.String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Request(&Message{Type: MethodBinding}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*Message
+	err = Replay(bytes.NewReader(b.Bytes()), HandlerFunc(func(w ResponseWriter, msg *Message) {
+		if len(msgs) == 0 && !sameAddr(w.Transport().LocalAddr(), addr) {
+			t.Errorf("wrong destination: %v", w.Transport().LocalAddr())
+		}
+		if len(msgs) == 1 && !sameAddr(w.Transport().RemoteAddr(), addr) {
+			t.Errorf("wrong source: %v", w.Transport().RemoteAddr())
+		}
+		msgs = append(msgs, msg)
+		w.Success()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Type != MethodBinding|KindRequest || msgs[1].Type != MethodBinding|KindResponse {
+		t.Fatalf("wrong messages: %v", msgs)
+	}
+	if !bytes.Equal(msgs[0].Transaction, msgs[1].Transaction) {
+		t.Error("wrong transaction")
+	}
+}
+
+func TestReplayError(t *testing.T) {
+	b := &bytes.Buffer{}
+	c, err := NewCaptureWriter(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5000}
+	req := &Message{Type: MethodBinding, Transaction: NewTransaction()}
+	// Not a STUN message
+	c.WritePacket(&CapturedPacket{Time: time.Now(), Src: src, Dst: dst, Data: []byte{0x80, 0, 0, 0}})
+	c.WritePacket(&CapturedPacket{Time: time.Now(), Src: src, Dst: dst, Data: req.Marshal(nil)})
+	// MAPPED-ADDRESS exceeding the message length
+	bad := []byte{0, 1, 0, 4, 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0, 1, 0, 100}
+	c.WritePacket(&CapturedPacket{Time: time.Now(), Src: src, Dst: dst, Data: bad})
+
+	n := 0
+	err = Replay(b, HandlerFunc(func(w ResponseWriter, msg *Message) {
+		n++
+	}))
+	e, ok := err.(*ReplayError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 1 || e.Index != 3 || !bytes.Equal(e.Packet.Data, bad) || !e.Packet.Src.IP.Equal(src.IP) || e.Packet.Dst.Port != dst.Port {
+		t.Errorf("wrong error: %v", e)
+	}
+}
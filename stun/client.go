@@ -0,0 +1,60 @@
+package stun
+
+import (
+	"net"
+	"sync"
+)
+
+// PacketClient is a STUN client sharing an existing socket of the application, e.g. to discover the server
+// reflexive address media is sent from for hole punching. Transactions with any number of servers are
+// served by one agent. Other datagrams, including STUN requests of peers, are read from the client.
+type PacketClient struct {
+	net.PacketConn
+	agent *Agent
+	conn  net.PacketConn
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// NewPacketClient returns a client reading the socket, so the application must read from the client instead.
+// Closing the client closes the socket.
+func NewPacketClient(c net.PacketConn, config *Config) *PacketClient {
+	pass := newPassConn(c, c.Close)
+	client := &PacketClient{
+		PacketConn: pass,
+		agent:      NewAgent(config),
+		conn:       c,
+		conns:      make(map[string]*Conn),
+	}
+	go func() {
+		client.agent.servePacket(c, func() *passConn { return pass })
+		// The socket is closed or broken, so pending transactions are canceled.
+		client.agent.m.Close()
+	}()
+	return client
+}
+
+// Request sends the request to the server and returns the response.
+// Sessions of long-term credentials are kept per server, see Config.AuthMethod.
+func (c *PacketClient) Request(req *Message, server net.Addr) (*Message, error) {
+	return c.serverConn(server).Request(req)
+}
+
+// Discover returns the server reflexive address of the socket discovered using the server.
+func (c *PacketClient) Discover(server net.Addr) (net.Addr, error) {
+	return c.serverConn(server).Discover()
+}
+
+// serverConn returns the connection to the server. It is never served or closed itself.
+func (c *PacketClient) serverConn(server net.Addr) *Conn {
+	key := server.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.conns[key]
+	if !ok {
+		conn = &Conn{Conn: &packetConn{c.conn, server}, agent: c.agent}
+		c.conns[key] = conn
+	}
+	return conn
+}
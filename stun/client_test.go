@@ -0,0 +1,103 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketClient(t *testing.T) {
+	var servers []net.Addr
+	for i := 0; i < 2; i++ {
+		srv := NewServer(nil)
+		defer srv.Close()
+		l, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		servers = append(servers, l.LocalAddr())
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewPacketClient(c, nil)
+	defer client.Close()
+	for _, it := range servers {
+		addr, err := client.Discover(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameAddr(addr, c.LocalAddr()) {
+			t.Error("wrong reflexive address:", addr)
+		}
+	}
+
+	// STUN requests of peers and other datagrams are read by the application.
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	req := &Message{Type: MethodBinding, Transaction: NewTransaction()}
+	large := make([]byte, 4000)
+	for _, it := range [][]byte{[]byte("media"), req.Marshal(nil), large} {
+		if _, err = peer.WriteTo(it, c.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := make([]byte, 8000)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := client.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "media" || !sameAddr(addr, peer.LocalAddr()) {
+		t.Errorf("wrong datagram: %q from %v", b[:n], addr)
+	}
+	if n, _, err = client.ReadFrom(b); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := UnmarshalMessage(b[:n]); err != nil || msg.Type != MethodBinding {
+		t.Error("wrong request:", msg, err)
+	}
+	if n, _, err = client.ReadFrom(b); err != nil || n != len(large) {
+		t.Errorf("wrong datagram of %d bytes: %v", n, err)
+	}
+}
+
+func TestPacketClientConcurrent(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	srv.Use(LongTermAuth("example.org", func(username string) (string, bool) {
+		return "secret", username == "user"
+	}))
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig.Clone()
+	config.AuthMethod = LongTermAuthMethod("user", "secret")
+	client := NewPacketClient(c, config)
+	defer client.Close()
+
+	// Requests to the same server share its session of long-term credentials.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Discover(l.LocalAddr()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
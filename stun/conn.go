@@ -3,18 +3,64 @@ package stun
 import (
 	"github.com/pkg/errors"
 	"net"
+	"sync"
 )
 
 type Conn struct {
 	net.Conn
 	agent *Agent
-	sess  *Session
+
+	mu   sync.Mutex
+	sess *Session
+	pass *passConn
+	err  error
 }
 
 func NewConn(conn net.Conn, config *Config) *Conn {
-	a := NewAgent(config)
-	go a.ServeConn(conn)
-	return &Conn{conn, a, nil}
+	c := &Conn{Conn: conn, agent: NewAgent(config)}
+	go func() {
+		var err error
+		if p, ok := conn.(*packetConn); ok {
+			err = c.agent.servePacket(p.PacketConn, c.passConn)
+		} else {
+			err = c.agent.ServeConn(conn)
+		}
+		// The connection is closed or broken, so pending transactions are canceled.
+		conn.Close()
+		c.agent.m.Close()
+		c.mu.Lock()
+		c.err = err
+		if c.pass != nil {
+			c.pass.shutdown(err)
+		}
+		c.mu.Unlock()
+	}()
+	return c
+}
+
+// PacketConn returns a net.PacketConn sharing the UDP socket of the connection, e.g. to send media
+// from the discovered server reflexive address. Responses of transactions of the connection are still
+// served by it, other datagrams are read from the returned connection. Closing it closes the connection.
+func (c *Conn) PacketConn() (net.PacketConn, error) {
+	p, ok := c.Conn.(*packetConn)
+	if !ok {
+		return nil, errNotPacketConn
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pass == nil {
+		c.pass = newPassConn(p.PacketConn, c.Close)
+		if c.err != nil {
+			c.pass.shutdown(c.err)
+		}
+	}
+	return c.pass, nil
+}
+
+func (c *Conn) passConn() *passConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pass
 }
 
 func (c *Conn) Network() string {
@@ -39,16 +85,18 @@ func (c *Conn) Request(req *Message) (res *Message, err error) {
 }
 
 func (c *Conn) RequestTransport(req *Message, to Transport) (res *Message, from Transport, err error) {
+	c.mu.Lock()
 	sess := c.sess
+	c.mu.Unlock()
 	auth := c.agent.config.AuthMethod
 	if to == nil {
 		to = c.Conn
 	}
 	for {
 		msg := &Message{
-			req.Type,
-			NewTransaction(),
-			append(sess.attrs(), req.Attributes...),
+			Type:        req.Type,
+			Transaction: req.Transaction,
+			Attributes:  append(sess.attrs(), req.Attributes...),
 		}
 		res, from, err = c.agent.RoundTrip(msg, to)
 		if err != nil {
@@ -58,12 +106,17 @@ func (c *Conn) RequestTransport(req *Message, to Transport) (res *Message, from
 		if code == nil {
 			// FIXME: authorize response...
 			if sess != nil {
+				c.mu.Lock()
 				c.sess = sess
+				c.mu.Unlock()
 			}
 			return
 		}
 		err = code
 		switch code.Code {
+		case CodeUnknownAttribute:
+			err = &UnknownAttributeError{res.UnknownAttributes()}
+			return
 		case CodeUnauthorized, CodeStaleNonce:
 			if auth == nil {
 				return
@@ -24,3 +24,18 @@ func TestDiscover(t *testing.T) {
 	}
 	t.Logf("Local address: %v, Server reflexive address: %v", conn.LocalAddr(), addr)
 }
+
+func TestUnknownAttributes(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+	_, err := conn.Request(&Message{Type: MethodBinding, Attributes: []Attr{Bytes(0x7fff, []byte("required"))}})
+	e, ok := err.(*UnknownAttributeError)
+	if !ok {
+		t.Fatal("wrong error:", err)
+	}
+	if len(e.Types) != 1 || e.Types[0] != 0x7fff {
+		t.Error("wrong unknown attributes:", e.Types)
+	}
+}
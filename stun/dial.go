@@ -0,0 +1,250 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionAttemptDelay is the delay between starts of raced connection attempts, as recommended by RFC 8305.
+var ConnectionAttemptDelay = 250 * time.Millisecond
+
+// DialURI connects to the STUN or TURN server of the URI. Servers are discovered using DNS, see Resolve.
+// If there are several addresses, e.g. both IPv4 and IPv6 ones, Binding transactions are raced in the RFC 8305
+// style: attempts follow the order of Resolve, which alternates address families within an SRV priority,
+// and start every ConnectionAttemptDelay or once the previous one fails.
+// The connection of the first answered transaction is returned, others are closed. An error response, e.g.
+// 401 Unauthorized before credentials are known, counts as an answer.
+// A single address is returned without a transaction, as there is nothing to race: like any connection,
+// it may turn out to be unreachable by the first request.
+func DialURI(u *URI, config *Config) (*Conn, error) {
+	if config == nil {
+		config = DefaultConfig
+	}
+	endpoints, err := Resolve(context.Background(), config.Resolver, u)
+	if err != nil {
+		return nil, err
+	}
+	config = uriConfig(u, config)
+	if len(endpoints) == 1 {
+		conn, err := dialEndpoint(u, endpoints[0])
+		if err != nil {
+			return nil, err
+		}
+		return NewConn(conn, config), nil
+	}
+	r, err := race(u, endpoints, config, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.Conn, nil
+}
+
+// dialDiscover connects to the server of the URI and discovers the server reflexive address.
+func dialDiscover(u *URI, config *Config) (*Conn, net.Addr, error) {
+	endpoints, err := Resolve(context.Background(), config.Resolver, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := race(u, endpoints, uriConfig(u, config), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Conn, r.Addr, nil
+}
+
+// Reflexive is a server reflexive address discovered using the connection.
+type Reflexive struct {
+	Conn *Conn
+	Addr net.Addr
+}
+
+// DiscoverDualStack discovers server reflexive addresses of each address family the STUN server of the URI
+// is reachable with, e.g. for ICE gathering. Addresses of each family are raced as by DialURI.
+// It returns an error only if no address is discovered.
+func DiscoverDualStack(uri string, config *Config) ([]*Reflexive, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = DefaultConfig
+	}
+	endpoints, err := Resolve(context.Background(), config.Resolver, u)
+	if err != nil {
+		return nil, err
+	}
+	config = uriConfig(u, config)
+	var v4, v6 []*Endpoint
+	for _, it := range endpoints {
+		if it.IP.To4() != nil {
+			v4 = append(v4, it)
+		} else {
+			v6 = append(v6, it)
+		}
+	}
+	var (
+		wg      sync.WaitGroup
+		results [2]*Reflexive
+		errs    [2]error
+	)
+	for i, it := range [][]*Endpoint{v6, v4} {
+		if len(it) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, e []*Endpoint) {
+			defer wg.Done()
+			results[i], errs[i] = race(u, e, config, false)
+		}(i, it)
+	}
+	wg.Wait()
+	var r []*Reflexive
+	for _, it := range results {
+		if it != nil {
+			r = append(r, it)
+		}
+	}
+	if r == nil {
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+		return nil, errs[1]
+	}
+	return r, nil
+}
+
+// uriConfig returns the config with long-term credentials of the URI, if any.
+func uriConfig(u *URI, config *Config) *Config {
+	if u.Username != "" {
+		config = config.Clone()
+		config.AuthMethod = LongTermAuthMethod(u.Username, u.Password)
+	}
+	return config
+}
+
+func dialEndpoint(u *URI, e *Endpoint) (net.Conn, error) {
+	switch {
+	case u.Secure():
+		return tls.Dial(e.Network, e.Addr(), &tls.Config{ServerName: u.Host})
+	case strings.HasPrefix(e.Network, "udp"):
+		return dialUDP(e.Network, e.Addr())
+	}
+	return dialTCP(e.Network, e.Addr())
+}
+
+// interleave orders endpoints alternating address families, starting with the family of the first endpoint.
+// The order of endpoints of the same family is kept.
+func interleave(endpoints []*Endpoint) []*Endpoint {
+	if len(endpoints) < 2 {
+		return endpoints
+	}
+	first := endpoints[0].IP.To4() != nil
+	var a, b []*Endpoint
+	for _, it := range endpoints {
+		if (it.IP.To4() != nil) == first {
+			a = append(a, it)
+		} else {
+			b = append(b, it)
+		}
+	}
+	r := make([]*Endpoint, 0, len(endpoints))
+	for len(a) > 0 || len(b) > 0 {
+		if len(a) > 0 {
+			r, a = append(r, a[0]), a[1:]
+		}
+		if len(b) > 0 {
+			r, b = append(r, b[0]), b[1:]
+		}
+	}
+	return r
+}
+
+// race runs Binding transactions to the endpoints and returns the first successful one.
+// If answered is set, an error response also completes the attempt, with no address.
+func race(u *URI, endpoints []*Endpoint, config *Config, answered bool) (*Reflexive, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("stun: no addresses of " + u.Host)
+	}
+	type result struct {
+		r   *Reflexive
+		err error
+	}
+	var (
+		results = make(chan result, len(endpoints))
+		mu      sync.Mutex
+		conns   []*Conn
+		done    bool
+	)
+	attempt := func(e *Endpoint) {
+		conn, err := dialEndpoint(u, e)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		mu.Lock()
+		if done {
+			mu.Unlock()
+			conn.Close()
+			results <- result{err: errCanceled}
+			return
+		}
+		c := NewConn(conn, config)
+		conns = append(conns, c)
+		mu.Unlock()
+		addr, err := c.Discover()
+		if _, ok := err.(*Error); ok && answered {
+			err = nil
+		}
+		if err != nil {
+			c.Close()
+			results <- result{err: err}
+			return
+		}
+		results <- result{r: &Reflexive{c, addr}}
+	}
+	next, running := 0, 0
+	start := func() {
+		go attempt(endpoints[next])
+		next++
+		running++
+	}
+	start()
+	t := time.NewTimer(ConnectionAttemptDelay)
+	defer t.Stop()
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// Close other connections, so their transactions are canceled.
+				mu.Lock()
+				done = true
+				for _, it := range conns {
+					if it != r.r.Conn {
+						it.Close()
+					}
+				}
+				mu.Unlock()
+				return r.r, nil
+			}
+			lastErr = r.err
+			if next < len(endpoints) {
+				start()
+				t.Reset(ConnectionAttemptDelay)
+			} else if running == 0 {
+				return nil, lastErr
+			}
+		case <-t.C:
+			if next < len(endpoints) {
+				start()
+				t.Reset(ConnectionAttemptDelay)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package stun
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInterleave(t *testing.T) {
+	var e []*Endpoint
+	for _, it := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"} {
+		e = append(e, &Endpoint{"udp", net.ParseIP(it), 3478})
+	}
+	var s []string
+	for _, it := range interleave(e) {
+		s = append(s, it.IP.String())
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("wrong order: %v", s)
+	}
+}
+
+// newDualStackServer serves on 127.0.0.1 and, if available, on ::1 with the same port.
+func newDualStackServer(t *testing.T) (srv *Server, port int, v6 bool) {
+	srv = NewServer(nil)
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(c)
+	port = c.LocalAddr().(*net.UDPAddr).Port
+	if c6, err := net.ListenPacket("udp6", net.JoinHostPort("::1", strconv.Itoa(port))); err == nil {
+		go srv.Serve(c6)
+		v6 = true
+	}
+	return
+}
+
+func TestDialRace(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(c)
+	config := DefaultConfig.Clone()
+	config.Resolver = &fakeResolver{hosts: map[string][]net.IPAddr{
+		// Nothing listens on the IPv6 address.
+		"example.org": ipAddrs("::1", "2001:db8::1", "127.0.0.1"),
+	}}
+	start := time.Now()
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	conn, err := Dial("stun:example.org:"+strconv.Itoa(port), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !sameAddr(conn.RemoteAddr(), c.LocalAddr()) {
+		t.Errorf("wrong server: %v", conn.RemoteAddr())
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("slow race: %v", d)
+	}
+}
+
+func TestDialRaceUnauthorized(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	srv.Use(LongTermAuth("example.org", func(username string) (string, bool) {
+		return "secret", username == "user"
+	}))
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(c)
+	config := DefaultConfig.Clone()
+	config.Resolver = &fakeResolver{hosts: map[string][]net.IPAddr{
+		"example.org": ipAddrs("2001:db8::1", "127.0.0.1"),
+	}}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	conn, err := Dial("stun:example.org:"+strconv.Itoa(port), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !sameAddr(conn.RemoteAddr(), c.LocalAddr()) {
+		t.Errorf("wrong server: %v", conn.RemoteAddr())
+	}
+	_, err = conn.Request(&Message{Type: MethodBinding})
+	if e, ok := err.(*Error); !ok || e.Code != CodeUnauthorized {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestDiscoverDualStack(t *testing.T) {
+	srv, port, v6 := newDualStackServer(t)
+	defer srv.Close()
+	config := DefaultConfig.Clone()
+	config.Resolver = &fakeResolver{hosts: map[string][]net.IPAddr{
+		"example.org": ipAddrs("127.0.0.1", "::1"),
+	}}
+	r, err := DiscoverDualStack("stun:example.org:"+strconv.Itoa(port), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range r {
+		defer it.Conn.Close()
+	}
+	n := 1
+	if v6 {
+		n = 2
+	}
+	if len(r) != n {
+		t.Fatalf("wrong number of addresses: %d", len(r))
+	}
+	for _, it := range r {
+		ip, port := SockAddr(it.Addr)
+		rip, _ := SockAddr(it.Conn.RemoteAddr())
+		if !ip.IsLoopback() || (ip.To4() == nil) != (rip.To4() == nil) || port != it.Conn.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("wrong reflexive address %v of %v", it.Addr, it.Conn.LocalAddr())
+		}
+	}
+}
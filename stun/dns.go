@@ -0,0 +1,219 @@
+package stun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSResolver looks up SRV and address records using net.Resolver and NAPTR records using a minimal DNS client,
+// as the standard library does not support them.
+type DNSResolver struct {
+	// Resolver is used for SRV and address records, nil means the default resolver
+	*net.Resolver
+	// Servers are addresses of name servers for NAPTR records, by default read from /etc/resolv.conf
+	Servers []string
+}
+
+const (
+	dnsTypeNAPTR   = 35
+	dnsClassIN     = 1
+	dnsNXDomain    = 3
+	dnsTimeout     = 5 * time.Second
+	dnsMessageSize = 4096
+)
+
+var errDNSFormat = errors.New("stun: malformed DNS response")
+
+// LookupNAPTR queries name servers one by one until one answers.
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	servers := r.Servers
+	if servers == nil {
+		servers = systemNameServers()
+	}
+	q, id, err := newDNSQuery(name, dnsTypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("stun: no name servers")
+	for _, it := range servers {
+		var b []byte
+		if b, err = exchangeDNS(ctx, it, q); err != nil {
+			continue
+		}
+		var records []*NAPTR
+		if records, err = parseNAPTR(b, id); err == nil {
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+// systemNameServers returns name servers of /etc/resolv.conf or the local name server.
+func systemNameServers() []string {
+	var r []string
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if f := strings.Fields(s.Text()); len(f) > 1 && f[0] == "nameserver" {
+				r = append(r, net.JoinHostPort(f[1], "53"))
+			}
+		}
+	}
+	if r == nil {
+		r = []string{"127.0.0.1:53"}
+	}
+	return r
+}
+
+func exchangeDNS(ctx context.Context, server string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	c.SetDeadline(deadline)
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+	b := make([]byte, dnsMessageSize)
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// newDNSQuery returns a recursive query of the name and the record type with a random ID.
+func newDNSQuery(name string, typ uint16) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(0x10000))
+	b := make([]byte, 12, 12+len(name)+6)
+	be.PutUint16(b, id)
+	be.PutUint16(b[2:], 0x0100)
+	be.PutUint16(b[4:], 1)
+	for _, it := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if it == "" || len(it) > 63 {
+			return nil, 0, errors.New("stun: invalid domain name " + name)
+		}
+		b = append(b, byte(len(it)))
+		b = append(b, it...)
+	}
+	b = append(b, 0, byte(typ>>8), byte(typ), 0, dnsClassIN)
+	return b, id, nil
+}
+
+func parseNAPTR(b []byte, id uint16) ([]*NAPTR, error) {
+	if len(b) < 12 || be.Uint16(b) != id || b[2]&0x80 == 0 {
+		return nil, errDNSFormat
+	}
+	switch rcode := b[3] & 0xf; rcode {
+	case 0:
+	case dnsNXDomain:
+		return nil, nil
+	default:
+		return nil, errors.New("stun: DNS error code " + strconv.Itoa(int(rcode)))
+	}
+	if b[2]&0x02 != 0 {
+		return nil, errors.New("stun: truncated DNS response")
+	}
+	qd, an := int(be.Uint16(b[4:])), int(be.Uint16(b[6:]))
+	pos := 12
+	var err error
+	for i := 0; i < qd; i++ {
+		if _, pos, err = dnsName(b, pos); err != nil {
+			return nil, err
+		}
+		pos += 4
+	}
+	var r []*NAPTR
+	for i := 0; i < an; i++ {
+		if _, pos, err = dnsName(b, pos); err != nil {
+			return nil, err
+		}
+		if pos+10 > len(b) {
+			return nil, errDNSFormat
+		}
+		typ, l := be.Uint16(b[pos:]), int(be.Uint16(b[pos+8:]))
+		pos += 10
+		if pos+l > len(b) {
+			return nil, errDNSFormat
+		}
+		if typ == dnsTypeNAPTR {
+			rec, err := parseNAPTRData(b, pos, pos+l)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, rec)
+		}
+		pos += l
+	}
+	return r, nil
+}
+
+func parseNAPTRData(b []byte, pos, end int) (*NAPTR, error) {
+	if pos+4 > end {
+		return nil, errDNSFormat
+	}
+	rec := &NAPTR{Order: be.Uint16(b[pos:]), Preference: be.Uint16(b[pos+2:])}
+	pos += 4
+	for _, it := range []*string{&rec.Flags, &rec.Service, &rec.Regexp} {
+		if pos >= end || pos+1+int(b[pos]) > end {
+			return nil, errDNSFormat
+		}
+		*it = string(b[pos+1 : pos+1+int(b[pos])])
+		pos += 1 + int(b[pos])
+	}
+	name, _, err := dnsName(b[:end], pos)
+	if err != nil {
+		return nil, err
+	}
+	rec.Replacement = name
+	return rec, nil
+}
+
+// dnsName decodes a possibly compressed domain name and returns the position after it.
+func dnsName(b []byte, pos int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+	)
+	for jumps := 0; ; {
+		if pos >= len(b) {
+			return "", 0, errDNSFormat
+		}
+		l := int(b[pos])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = pos + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if pos+1 >= len(b) || jumps > 16 {
+				return "", 0, errDNSFormat
+			}
+			if next < 0 {
+				next = pos + 2
+			}
+			pos = int(be.Uint16(b[pos:]) & 0x3fff)
+			jumps++
+		case l&0xc0 != 0 || pos+1+l > len(b):
+			return "", 0, errDNSFormat
+		default:
+			labels = append(labels, string(b[pos+1:pos+1+l]))
+			pos += 1 + l
+		}
+	}
+}
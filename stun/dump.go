@@ -0,0 +1,144 @@
+package stun
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseDump decodes a hex or base64 dump of a message.
+// Whitespace, colons and "0x" prefixes of hex dumps, e.g. copied from Wireshark, are ignored.
+func ParseDump(s string) ([]byte, error) {
+	h := strings.NewReplacer("0x", "", "0X", "", ":", "", " ", "", "\t", "", "\r", "", "\n", "").Replace(s)
+	if b, err := hex.DecodeString(h); err == nil {
+		return b, nil
+	}
+	s = strings.Join(strings.Fields(s), "")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, errors.New("stun: dump is neither hex nor base64")
+}
+
+// Dump writes the header and each attribute of the raw message with offsets, lengths, padding and decoded values,
+// e.g. XOR-decoded addresses. MESSAGE-INTEGRITY is verified if the key is not nil, FINGERPRINT is always verified.
+// Dumping stops at the first malformed field, which is reported with its offset. It returns the decoding error, if any.
+func Dump(w io.Writer, b []byte, key []byte) error {
+	fail := func(pos int, err error) error {
+		fmt.Fprintf(w, "%04x  error: %v\n", pos, err)
+		if pos < len(b) {
+			fmt.Fprintf(w, "%04x  remaining %d bytes: %x\n", pos, len(b)-pos, b[pos:])
+		}
+		return err
+	}
+	if len(b) < 20 {
+		return fail(0, fmt.Errorf("stun: message is %d bytes, shorter than the 20 byte header", len(b)))
+	}
+	m := &Message{Type: be.Uint16(b), Transaction: b[4:20]}
+	n := int(be.Uint16(b[2:]))
+	fmt.Fprintf(w, "%04x  header %s (0x%04x) length=%d\n", 0, MethodName(m.Type), m.Type, n)
+	if b[0]&0xc0 != 0 {
+		return fail(0, errors.New("stun: the first two bits are not zero"))
+	}
+	if m.Classic() {
+		fmt.Fprintf(w, "%04x  transaction %x (RFC 3489, no magic cookie)\n", 4, m.Transaction)
+	} else {
+		fmt.Fprintf(w, "%04x  magic cookie %x\n", 4, b[4:8])
+		fmt.Fprintf(w, "%04x  transaction %x\n", 8, b[8:20])
+	}
+	switch {
+	case n%4 != 0:
+		return fail(2, fmt.Errorf("stun: message length %d is not a multiple of 4", n))
+	case 20+n > len(b):
+		return fail(2, fmt.Errorf("stun: message length %d exceeds %d bytes of data", n, len(b)-20))
+	}
+	p := b[:20+n]
+	var firstErr error
+	for pos := 20; pos < len(p); {
+		if len(p)-pos < 4 {
+			return fail(pos, errors.New("stun: truncated attribute header"))
+		}
+		typ, l := be.Uint16(p[pos:]), int(be.Uint16(p[pos+2:]))
+		pad := (4 - l&3) & 3
+		fmt.Fprintf(w, "%04x  %s (0x%04x) length=%d", pos, AttrName(typ), typ, l)
+		if pad > 0 {
+			fmt.Fprintf(w, " padding=%d", pad)
+		}
+		if pos+4+l+pad > len(p) {
+			fmt.Fprintln(w)
+			return fail(pos+2, fmt.Errorf("stun: attribute length %d exceeds the message", l))
+		}
+		s, attr, err := m.unmarshalAttr(p, pos)
+		if err != nil {
+			fmt.Fprintln(w)
+			return fail(pos+4, err)
+		}
+		v, err := dumpValue(attr, p[pos+4:pos+4+l], key)
+		fmt.Fprintf(w, ": %s\n", v)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		pos += s
+	}
+	if len(b) > len(p) {
+		fmt.Fprintf(w, "%04x  %d trailing bytes after the message\n", len(p), len(b)-len(p))
+	}
+	_, err := UnmarshalMessage(b)
+	if _, ok := err.(*UnknownAttributeError); ok {
+		// Unknown attributes are dumped as raw data above.
+		return err
+	}
+	if err != nil {
+		return fail(0, err)
+	}
+	return firstErr
+}
+
+// dumpValue returns the decoded value of the attribute and an error if its checksum is invalid.
+func dumpValue(attr Attr, data, key []byte) (string, error) {
+	switch v := attr.(type) {
+	case nil:
+		return fmt.Sprintf("unknown comprehension-required %x", data), nil
+	case *integrity:
+		switch {
+		case key == nil:
+			return fmt.Sprintf("%x (not verified, no key)", v.sum), nil
+		case v.Check(key):
+			return fmt.Sprintf("%x (valid)", v.sum), nil
+		}
+		return fmt.Sprintf("%x (INVALID)", v.sum), errors.New("stun: invalid MESSAGE-INTEGRITY")
+	case *fingerprint:
+		if v.Check() {
+			return fmt.Sprintf("0x%08x (valid)", v.sum), nil
+		}
+		r := v.raw
+		l := be.Uint16(r[2:])
+		be.PutUint16(r[2:], uint16(len(r)-20))
+		sum := v.Sum(r[:len(r)-8])
+		be.PutUint16(r[2:], l)
+		return fmt.Sprintf("0x%08x (INVALID, expected 0x%08x)", v.sum, sum), errors.New("stun: invalid FINGERPRINT")
+	case *Address:
+		if v.typ == AttrXorMappedAddress || v.typ == AttrXorPeerAddress || v.typ == AttrXorRelayedAddress {
+			return fmt.Sprintf("%v (xor %x)", v, data), nil
+		}
+		return v.String(), nil
+	case *Raw:
+		switch v.typ {
+		case AttrPadding:
+			return fmt.Sprintf("%d bytes", len(v.Data)), nil
+		case AttrUsername, AttrRealm, AttrNonce, AttrSoftware, AttrPassword:
+			return fmt.Sprintf("%q", v.Data), nil
+		}
+		return fmt.Sprintf("%x", v.Data), nil
+	case *Text:
+		return fmt.Sprintf("%q", v.Value), nil
+	case flag:
+		return "present", nil
+	}
+	return fmt.Sprint(attr), nil
+}
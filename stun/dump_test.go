@@ -0,0 +1,81 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	key := []byte("secret")
+	m := &Message{
+		Type:        MethodBinding | KindResponse,
+		Transaction: NewTransaction(),
+		Attributes: []Attr{
+			String(AttrSoftware, "test"),
+			Addr(AttrXorMappedAddress, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853}),
+			MessageIntegrity(key),
+			Fingerprint,
+		},
+	}
+	raw := m.Marshal(nil)
+	h := hex.EncodeToString(raw)
+	for _, s := range []string{h, "0x" + h[:10] + " " + h[10:], base64.StdEncoding.EncodeToString(raw)} {
+		b, err := ParseDump(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, raw) {
+			t.Fatalf("wrong dump %q", s)
+		}
+	}
+
+	w := &bytes.Buffer{}
+	if err := Dump(w, raw, key); err != nil {
+		t.Fatalf("%v\n%s", err, w)
+	}
+	for _, it := range []string{
+		"0000  header BindingResponse (0x0101) length=",
+		"0014  SOFTWARE (0x8022) length=4: \"test\"",
+		"001c  XOR-MAPPED-ADDRESS (0x0020) length=8: 192.0.2.1:32853 (xor ",
+		"MESSAGE-INTEGRITY (0x0008) length=20: ",
+		"(valid)",
+	} {
+		if !strings.Contains(w.String(), it) {
+			t.Errorf("missing %q in:\n%s", it, w)
+		}
+	}
+	w.Reset()
+	if err := Dump(w, raw, []byte("wrong")); err == nil || !strings.Contains(w.String(), "(INVALID)") {
+		t.Errorf("invalid integrity is not reported: %v\n%s", err, w)
+	}
+
+	// SOFTWARE exceeding the message
+	bad := append([]byte(nil), raw...)
+	be.PutUint16(bad[22:], 200)
+	w.Reset()
+	if err := Dump(w, bad, nil); err == nil || !strings.Contains(w.String(), "0016  error: ") {
+		t.Errorf("malformed attribute is not reported: %v\n%s", err, w)
+	}
+
+	unknown := &Message{Type: MethodBinding, Attributes: []Attr{String(AttrSoftware, "test"), Bytes(0x7fff, []byte("required"))}}
+	w.Reset()
+	err := Dump(w, unknown.Marshal(nil), nil)
+	if _, ok := err.(*UnknownAttributeError); !ok {
+		t.Errorf("wrong error: %v", err)
+	}
+	for _, it := range []string{
+		"0014  SOFTWARE (0x8022) length=4: \"test\"",
+		"001c  0x7fff (0x7fff) length=8: unknown comprehension-required 7265717569726564",
+	} {
+		if !strings.Contains(w.String(), it) {
+			t.Errorf("missing %q in:\n%s", it, w)
+		}
+	}
+	if s := w.String(); strings.Contains(s, "error") || strings.Contains(s, "remaining") {
+		t.Errorf("unknown attribute is reported as malformed:\n%s", s)
+	}
+}
@@ -140,6 +140,12 @@ func genMethods(records []*Record, b *bytes.Buffer) error {
 	return nil
 }
 
+// handwritten lists attributes declared in attribute.go, which are skipped to avoid duplicate constants.
+var handwritten = map[string]bool{
+	"ADDITIONAL-ADDRESS-FAMILY": true,
+	"ADDRESS-ERROR-CODE":        true,
+}
+
 func genAttributes(records []*Record, b *bytes.Buffer) error {
 	c, d, m := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
 	ref := ""
@@ -150,6 +156,9 @@ func genAttributes(records []*Record, b *bytes.Buffer) error {
 				a = d
 			}
 			v := strings.Replace(it.Name, "_", "-", -1)
+			if handwritten[v] {
+				continue
+			}
 			n := strings.Replace(v, "-", " ", -1)
 			parts := strings.Fields(n)
 			for i, s := range parts {
@@ -0,0 +1,136 @@
+package stun
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of messages per source address prefix using token buckets.
+type RateLimiter struct {
+	// Rate is the number of messages per second allowed for a prefix
+	Rate float64
+	// Burst is the maximum number of messages allowed at once for a prefix
+	Burst int
+	// IPv4Prefix is the prefix length for IPv4 addresses, default is 32
+	IPv4Prefix int
+	// IPv6Prefix is the prefix length for IPv6 addresses, default is 64
+	IPv6Prefix int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     list.List // of *bucket, the most recently used first
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is the maximum number of buckets. The least recently used bucket is removed to add a new one,
+// so a flood of spoofed source addresses does not exhaust memory.
+const maxBuckets = 1 << 16
+
+// NewRateLimiter returns a rate limiter allowing rate messages per second with the burst for each source address.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// Allow reports whether a message from the address is allowed and takes a token from its bucket.
+func (l *RateLimiter) Allow(addr net.Addr) bool {
+	ip, _ := SockAddr(addr)
+	key := l.prefix(ip).String()
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*list.Element)
+	}
+	e, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(e)
+	} else {
+		if l.lru.Len() >= maxBuckets {
+			old := l.lru.Back()
+			l.lru.Remove(old)
+			delete(l.buckets, old.Value.(*bucket).key)
+		}
+		e = l.lru.PushFront(&bucket{key: key, tokens: float64(l.Burst), last: now})
+		l.buckets[key] = e
+	}
+	b := e.Value.(*bucket)
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if max := float64(l.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *RateLimiter) prefix(ip net.IP) net.IP {
+	if v := ip.To4(); v != nil {
+		n := l.IPv4Prefix
+		if n <= 0 {
+			n = 32
+		}
+		return v.Mask(net.CIDRMask(n, 32))
+	}
+	n := l.IPv6Prefix
+	if n <= 0 {
+		n = 64
+	}
+	return ip.Mask(net.CIDRMask(n, 128))
+}
+
+// RateLimit returns a middleware which discards messages exceeding the rate limit of the source address.
+func RateLimit(l *RateLimiter) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, msg *Message) {
+			if l.Allow(w.Transport().RemoteAddr()) {
+				h.ServeSTUN(w, msg)
+			}
+		})
+	}
+}
+
+// FilterIP returns a middleware which discards messages from source addresses not contained by allow networks,
+// if any, or contained by deny networks.
+func FilterIP(allow, deny []*net.IPNet) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, msg *Message) {
+			ip, _ := SockAddr(w.Transport().RemoteAddr())
+			if (len(allow) == 0 || containsIP(allow, ip)) && !containsIP(deny, ip) {
+				h.ServeSTUN(w, msg)
+			}
+		})
+	}
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, it := range networks {
+		if it.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses networks in CIDR notation, e.g. "192.0.2.0/24" or "2001:db8::/32".
+func ParseCIDRs(s ...string) ([]*net.IPNet, error) {
+	r := make([]*net.IPNet, 0, len(s))
+	for _, it := range s {
+		_, n, err := net.ParseCIDR(it)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
@@ -0,0 +1,141 @@
+package stun
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(0, 2)
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}
+	for i, it := range []bool{true, true, false} {
+		if l.Allow(a) != it {
+			t.Errorf("message %d: expected %v", i, it)
+		}
+	}
+	if !l.Allow(b) {
+		t.Error("other address is limited")
+	}
+	l = &RateLimiter{Burst: 1, IPv6Prefix: 48}
+	if !l.Allow(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}) || l.Allow(&net.UDPAddr{IP: net.ParseIP("2001:db8:0:1::1")}) {
+		t.Error("prefix is not limited")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := NewRateLimiter(0, 2)
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 0)}
+	l.Allow(first)
+	for i := 1; i <= maxBuckets; i++ {
+		// Buckets are not full, so they are kept until evicted.
+		l.Allow(&net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))})
+	}
+	if len(l.buckets) != maxBuckets || l.lru.Len() != maxBuckets {
+		t.Errorf("wrong number of buckets: %d", len(l.buckets))
+	}
+	if _, ok := l.buckets[first.IP.String()]; ok {
+		t.Error("least recently used bucket is not evicted")
+	}
+	n := maxBuckets
+	last := &net.UDPAddr{IP: net.IPv4(10, byte(n>>16), byte(n>>8), byte(n))}
+	if !l.Allow(last) || l.Allow(last) {
+		t.Error("recently used bucket is evicted")
+	}
+}
+
+func TestFilterIP(t *testing.T) {
+	allow, err := ParseCIDRs("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseCIDRs("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	h := FilterIP(allow, deny)(HandlerFunc(func(w ResponseWriter, msg *Message) {
+		n++
+	}))
+	for _, it := range []string{"127.0.0.1", "127.0.0.2", "192.0.2.1"} {
+		tr := &packetConn{nil, &net.UDPAddr{IP: net.ParseIP(it)}}
+		h.ServeSTUN(&responseWriter{tr: tr}, &Message{})
+	}
+	if n != 1 {
+		t.Error("wrong number of allowed messages:", n)
+	}
+}
+
+func TestFilterIPUnknownAttributes(t *testing.T) {
+	deny, err := ParseCIDRs("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(nil)
+	defer srv.Close()
+	srv.Use(FilterIP(nil, deny))
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A denied client gets no 420 (Unknown Attribute) response either.
+	req := &Message{Type: MethodBinding, Attributes: []Attr{Bytes(0x7fff, []byte("required"))}}
+	if _, err = c.WriteTo(req.Marshal(nil), l.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	b := make([]byte, 1500)
+	if n, _, err := c.ReadFrom(b); err == nil {
+		t.Errorf("denied client is answered: %x", b[:n])
+	}
+}
+
+func TestLimitResponseSize(t *testing.T) {
+	config := DefaultConfig.Clone()
+	config.LimitResponseSize = true
+	srv := NewServer(config)
+	defer srv.Close()
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+
+	req := &Message{Type: MethodBinding, Attributes: []Attr{Padding(16)}}
+	res, err := conn.Request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Attributes = append(DefaultConfig.attrs(), req.Attributes...)
+	if n := len(res.Marshal(nil)); n > len(req.Marshal(nil)) {
+		t.Errorf("response is larger than request: %d", n)
+	}
+	if res.XorMappedAddress() == nil {
+		t.Error("no mapped address")
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	b, err := hex.DecodeString(samples[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := requestSize(req); n != len(b) {
+		t.Errorf("wrong request size: %d", n)
+	}
+	res := &Message{Type: MethodBinding | KindResponse}
+	res.Add(NewAddress(AttrXorMappedAddress, net.ParseIP("192.0.2.1"), 32853))
+	if limitSize(res, requestSize(&Message{Type: MethodBinding})) {
+		t.Error("response fits a bare request")
+	}
+}
@@ -7,8 +7,9 @@ import (
 	"io"
 	"math/rand"
 	"net"
-	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -19,10 +20,42 @@ const (
 )
 
 // Message represents a STUN message.
+// Decoded transaction and attributes refer to the buffer passed to Unmarshal.
 type Message struct {
 	Type        uint16
 	Transaction []byte
 	Attributes  []Attr
+
+	// size is the length of the decoded message.
+	size int
+	// unknown holds unknown comprehension-required attributes of a request, answered by Server with 420.
+	unknown []uint16
+	// decoded holds attributes allocated by Unmarshal. Only they are reused, others may be shared.
+	decoded []Attr
+	// free holds attributes of the previous message by type.
+	free map[uint16][]Attr
+}
+
+// Reset resets the message for reuse.
+// Attributes decoded by Unmarshal are reused by the next Unmarshal and must not be retained.
+func (m *Message) Reset() {
+	m.Type = 0
+	m.Transaction = nil
+	m.size = 0
+	m.unknown = nil
+	if m.free == nil && len(m.decoded) > 0 {
+		m.free = make(map[uint16][]Attr)
+	}
+	for i, it := range m.decoded {
+		typ := it.Type()
+		m.free[typ] = append(m.free[typ], it)
+		m.decoded[i] = nil
+	}
+	m.decoded = m.decoded[:0]
+	for i := range m.Attributes {
+		m.Attributes[i] = nil
+	}
+	m.Attributes = m.Attributes[:0]
 }
 
 func (m *Message) Marshal(p []byte) []byte {
@@ -37,7 +70,7 @@ func (m *Message) Marshal(p []byte) []byte {
 		rand.Read(b[8:20])
 	}
 
-	sort.Sort(byPosition(m.Attributes))
+	sortAttrs(m.Attributes)
 	for _, attr := range m.Attributes {
 		r = m.marshalAttr(r, attr, pos)
 	}
@@ -52,7 +85,7 @@ func (m *Message) marshalAttr(p []byte, attr Attr, pos int) []byte {
 	be.PutUint16(b, attr.Type())
 
 	switch v := attr.(type) {
-	case *addr:
+	case *Address:
 		r = v.MarshalAddr(r, r[pos+4:])
 	case *integrity:
 		r = v.MarshalSum(r, r[pos:])
@@ -73,33 +106,36 @@ func (m *Message) marshalAttr(p []byte, attr Attr, pos int) []byte {
 	return r
 }
 
+// Unmarshal decodes the message at the start of b and returns its length. The transaction and attribute values
+// refer to b without copying, so b must not be modified while the message is used, see UnmarshalMessage.
 func (m *Message) Unmarshal(b []byte) (n int, err error) {
-	if len(b) < 20 {
-		err = io.EOF
-		return
-	}
-	l := int(be.Uint16(b[2:])) + 20
-	if len(b) < l {
+	l := messageLen(b)
+	if l == 0 {
 		err = io.EOF
 		return
 	}
-	pos, p := 20, make([]byte, l)
-	copy(p, b[:l])
+	pos, p := 20, b[:l]
 
 	m.Type = be.Uint16(p)
 	m.Transaction = p[4:20]
+	m.size = l
 
+	var unknown []uint16
 	for pos < len(p) {
 		s, attr, err := m.unmarshalAttr(p, pos)
 		if err != nil {
 			return 0, err
 		}
-		pos += s
 		if attr != nil {
 			m.Attributes = append(m.Attributes, attr)
+		} else {
+			unknown = append(unknown, be.Uint16(p[pos:]))
 		}
+		pos += s
+	}
+	if unknown != nil {
+		return l, &UnknownAttributeError{unknown}
 	}
-
 	return l, nil
 }
 
@@ -110,7 +146,14 @@ func (m *Message) unmarshalAttr(p []byte, pos int) (n int, attr Attr, err error)
 		return
 	}
 	typ := be.Uint16(b)
-	attr, n = newAttr(typ), int(be.Uint16(b[2:]))+4
+	attr, n = m.newAttr(typ), int(be.Uint16(b[2:]))+4
+	if attr != nil {
+		m.decoded = append(m.decoded, attr)
+	} else if typ >= 0x8000 {
+		// Keep unknown comprehension-optional attributes as is. They are not reused, so the free list
+		// holds known types only.
+		attr = &Raw{typ: typ}
+	}
 	if len(b) < n {
 		err = errFormat
 		return
@@ -119,7 +162,7 @@ func (m *Message) unmarshalAttr(p []byte, pos int) (n int, attr Attr, err error)
 	b = b[4:n]
 	if attr != nil {
 		switch v := attr.(type) {
-		case *addr:
+		case *Address:
 			err = v.UnmarshalAddr(b, m.Transaction)
 		case *integrity:
 			err = v.UnmarshalSum(b, p[:pos+n])
@@ -128,8 +171,6 @@ func (m *Message) unmarshalAttr(p []byte, pos int) (n int, attr Attr, err error)
 		default:
 			err = attr.Unmarshal(b)
 		}
-	} else if typ < 0x8000 {
-		err = errFormat
 	}
 	if err != nil {
 		err = &errAttribute{err, typ}
@@ -144,6 +185,35 @@ func (m *Message) unmarshalAttr(p []byte, pos int) (n int, attr Attr, err error)
 	return
 }
 
+// newAttr returns an attribute of the previous message if any, or a new one.
+func (m *Message) newAttr(typ uint16) Attr {
+	if r := m.free[typ]; len(r) > 0 {
+		last := len(r) - 1
+		it := r[last]
+		r[last] = nil
+		m.free[typ] = r[:last]
+		return it
+	}
+	return newAttr(typ)
+}
+
+// messageLen returns the length of the STUN message at the start of b or 0 if b is too short.
+func messageLen(b []byte) int {
+	if len(b) < 20 {
+		return 0
+	}
+	l := int(be.Uint16(b[2:])) + 20
+	if len(b) < l {
+		return 0
+	}
+	return l
+}
+
+// Classic reports whether the message is an RFC 3489 message without the magic cookie.
+func (m *Message) Classic() bool {
+	return len(m.Transaction) >= 4 && !bytes.Equal(m.Transaction[:4], magicCookie)
+}
+
 func (m *Message) Kind() uint16 {
 	return m.Type & 0x110
 }
@@ -199,7 +269,7 @@ func (m *Message) GetString(typ uint16) string {
 
 func (m *Message) GetAddr(network string, typ ...uint16) net.Addr {
 	for _, t := range typ {
-		if addr, ok := m.Get(t).(*addr); ok {
+		if addr, ok := m.Get(t).(*Address); ok {
 			return addr.Addr(network)
 		}
 	}
@@ -208,15 +278,15 @@ func (m *Message) GetAddr(network string, typ ...uint16) net.Addr {
 
 func (m *Message) GetInt(typ uint16) (v uint64, ok bool) {
 	attr := m.Get(typ)
-	if r, ok := attr.(*number); ok {
-		return r.v, true
+	if r, ok := attr.(*Number); ok {
+		return r.Value, true
 	}
 	return
 }
 
 func (m *Message) GetBytes(typ uint16) []byte {
-	if attr, ok := m.Get(typ).(*raw); ok {
-		return attr.data
+	if attr, ok := m.Get(typ).(*Raw); ok {
+		return attr.Data
 	}
 	return nil
 }
@@ -228,6 +298,68 @@ func (m *Message) GetError() *Error {
 	return nil
 }
 
+// GetAddress returns the first address attribute of the given types or nil.
+func (m *Message) GetAddress(typ ...uint16) *Address {
+	for _, t := range typ {
+		if addr, ok := m.Get(t).(*Address); ok {
+			return addr
+		}
+	}
+	return nil
+}
+
+// XorMappedAddress returns the XOR-MAPPED-ADDRESS attribute or nil.
+func (m *Message) XorMappedAddress() *Address {
+	return m.GetAddress(AttrXorMappedAddress)
+}
+
+// MappedAddress returns the MAPPED-ADDRESS attribute or nil.
+func (m *Message) MappedAddress() *Address {
+	return m.GetAddress(AttrMappedAddress)
+}
+
+// Username returns the USERNAME attribute value.
+func (m *Message) Username() string {
+	return m.GetString(AttrUsername)
+}
+
+// Lifetime returns the LIFETIME attribute value.
+func (m *Message) Lifetime() (time.Duration, bool) {
+	v, ok := m.GetInt(AttrLifetime)
+	return time.Duration(v) * time.Second, ok
+}
+
+// ChangeRequest returns the CHANGE-REQUEST attribute flags.
+func (m *Message) ChangeRequest() (uint64, bool) {
+	return m.GetInt(AttrChangeRequest)
+}
+
+// UnknownAttributes returns the attribute types listed by the UNKNOWN-ATTRIBUTES attribute.
+func (m *Message) UnknownAttributes() []uint16 {
+	if attr, ok := m.Get(AttrUnknownAttributes).(*UnknownAttributes); ok {
+		return *attr
+	}
+	return nil
+}
+
+// XorRelayedAddresses returns the XOR-RELAYED-ADDRESS attributes, one per address family of a dual allocation.
+func (m *Message) XorRelayedAddresses() (r []*Address) {
+	for _, attr := range m.Attributes {
+		if addr, ok := attr.(*Address); ok && addr.typ == AttrXorRelayedAddress {
+			r = append(r, addr)
+		}
+	}
+	return
+}
+
+// AddressError returns the ADDRESS-ERROR-CODE attribute or nil.
+func (m *Message) AddressError() *AddressError {
+	if err, ok := m.Get(AttrAddressErrorCode).(*AddressError); ok {
+		return err
+	}
+	return nil
+}
+
 func (m *Message) CheckIntegrity(key []byte) bool {
 	if attr, ok := m.Get(AttrMessageIntegrity).(*integrity); ok {
 		return attr.Check(key)
@@ -243,7 +375,7 @@ func (m *Message) CheckFingerprint() bool {
 }
 
 func (m *Message) String() string {
-	sort.Sort(byPosition(m.Attributes))
+	sortAttrs(m.Attributes)
 
 	// TODO: use sprintf
 
@@ -262,13 +394,17 @@ func (m *Message) String() string {
 		b.WriteString(", ")
 		b.WriteString(AttrName(attr.Type()))
 		switch v := attr.(type) {
-		case *raw:
+		case *Raw:
+			if v.typ == AttrPadding {
+				b.WriteString(": " + strconv.Itoa(len(v.Data)) + " bytes")
+				break
+			}
 			b.WriteString(": \"")
-			b.Write(v.data)
+			b.Write(v.Data)
 			b.WriteByte('"')
-		case *str:
+		case *Text:
 			b.WriteString(": \"")
-			b.WriteString(v.data)
+			b.WriteString(v.Value)
 			b.WriteByte('"')
 		case flag, *integrity, *fingerprint:
 		default:
@@ -295,9 +431,10 @@ func MethodName(typ uint16) string {
 	return "0x" + strconv.FormatUint(uint64(typ), 16)
 }
 
+// UnmarshalMessage decodes a copy of b, so the buffer may be reused once it returns.
 func UnmarshalMessage(b []byte) (*Message, error) {
 	m := &Message{}
-	if _, err := m.Unmarshal(b); err != nil {
+	if _, err := m.Unmarshal(append([]byte(nil), b...)); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -323,24 +460,52 @@ func NewTransaction() []byte {
 	return id
 }
 
-type byPosition []Attr
+// NewClassicTransaction returns an RFC 3489 transaction ID without the magic cookie.
+func NewClassicTransaction() []byte {
+	id := make([]byte, 16)
+	for {
+		rand.Read(id)
+		if !bytes.Equal(id[:4], magicCookie) {
+			return id
+		}
+	}
+}
 
-func (s byPosition) Len() int      { return len(s) }
-func (s byPosition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s byPosition) Less(i, j int) bool {
-	a, b := s[i].Type(), s[j].Type()
-	switch b {
-	case a:
-		return i < j
+// sortAttrs moves MESSAGE-INTEGRITY and FINGERPRINT attributes to the end keeping the order of others.
+// It is an insertion sort, so it does not allocate.
+func sortAttrs(s []Attr) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && attrPosition(s[j]) < attrPosition(s[j-1]); j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
+
+func attrPosition(attr Attr) int {
+	switch attr.Type() {
 	case AttrMessageIntegrity:
-		return a != AttrFingerprint
+		return 1
 	case AttrFingerprint:
-		return true
+		return 2
 	default:
-		return i < j
+		return 0
 	}
 }
 
+// UnknownAttributeError is returned when a message contains comprehension-required
+// attributes which are not understood. The message is decoded except these attributes.
+type UnknownAttributeError struct {
+	Types []uint16
+}
+
+func (err *UnknownAttributeError) Error() string {
+	b := make([]string, len(err.Types))
+	for i, it := range err.Types {
+		b[i] = AttrName(it)
+	}
+	return "stun: unknown attributes: " + strings.Join(b, ", ")
+}
+
 type errAttribute struct {
 	error
 	typ uint16
@@ -349,3 +514,7 @@ type errAttribute struct {
 func (err errAttribute) Error() string {
 	return "attribute " + AttrName(err.typ) + ": " + err.error.Error()
 }
+
+func (err errAttribute) Unwrap() error {
+	return err.error
+}
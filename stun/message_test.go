@@ -1,9 +1,13 @@
 package stun
 
 import (
+	"bytes"
 	"encoding/hex"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Test Vectors for STUN. RFC 5769.
@@ -24,10 +28,13 @@ func BenchmarkDecode(b *testing.B) {
 		}
 		data[i] = d
 	}
+	m := &Message{}
+	b.ReportAllocs()
+	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		for _, d := range data {
-			_, err := UnmarshalMessage(d)
-			if err != nil {
+			m.Reset()
+			if _, err := m.Unmarshal(d); err != nil {
 				b.Fatal(err)
 			}
 		}
@@ -48,6 +55,8 @@ func BenchmarkEncode(b *testing.B) {
 		data[i] = m
 	}
 	d := getBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		for _, m := range data {
 			d = m.Marshal(d[:0])
@@ -57,11 +66,120 @@ func BenchmarkEncode(b *testing.B) {
 }
 
 func BenchmarkBuffer(b *testing.B) {
+	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
 		putBuffer(getBuffer())
 	}
 }
 
+func TestAllocs(t *testing.T) {
+	data := make([][]byte, len(samples))
+	for i, it := range samples {
+		d, err := hex.DecodeString(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[i] = d
+	}
+	m, p := &Message{}, getBuffer()
+	defer putBuffer(p)
+	n := testing.AllocsPerRun(100, func() {
+		for _, d := range data {
+			m.Reset()
+			if _, err := m.Unmarshal(d); err != nil {
+				t.Fatal(err)
+			}
+			p = m.Marshal(p[:0])
+		}
+	})
+	if n != 0 {
+		t.Errorf("decode and encode allocate %v times per run", n)
+	}
+}
+
+func TestAllocsManyAttributes(t *testing.T) {
+	m := &Message{Type: MethodBinding}
+	for i := 0; i < 1000; i++ {
+		m.Add(String(AttrSoftware, "software"))
+		m.Add(String(AttrUsername, "user"))
+	}
+	b := m.Marshal(nil)
+	m = &Message{}
+	decode := func() {
+		m.Reset()
+		if _, err := m.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first Reset fills the free list.
+	decode()
+	decode()
+	n := testing.AllocsPerRun(10, decode)
+	if n != 0 {
+		t.Errorf("decode allocates %v times per run", n)
+	}
+	if len(m.Attributes) != 2000 {
+		t.Error("wrong number of attributes:", len(m.Attributes))
+	}
+}
+
+func TestReset(t *testing.T) {
+	b, err := hex.DecodeString(samples[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{}
+	for _, it := range []string{samples[2], samples[1]} {
+		d, err := hex.DecodeString(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Reset()
+		if _, err = m.Unmarshal(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := m.Marshal(nil); !bytes.Equal(v, r.Marshal(nil)) {
+		t.Errorf("wrong message: %x", v)
+	}
+	if !m.CheckIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")) || !m.CheckFingerprint() {
+		t.Error("integrity check failed")
+	}
+	if a := m.XorMappedAddress(); a == nil || !a.IP.Equal(net.ParseIP("192.0.2.1")) || a.Port != 32853 {
+		t.Error("wrong address:", a)
+	}
+}
+
+func TestResetShared(t *testing.T) {
+	software := String(AttrSoftware, "shared").(*Text)
+	m := &Message{Type: MethodBinding}
+	m.Add(software)
+	m.Add(Fingerprint)
+	b := m.Marshal(nil)
+	m.Reset()
+	d, err := hex.DecodeString(samples[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Unmarshal(d); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(AttrFingerprint) == Fingerprint || m.Get(AttrSoftware) == Attr(software) {
+		t.Error("attributes added by the caller are reused")
+	}
+	m.Reset()
+	if _, err = m.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !m.CheckFingerprint() || software.Value != "shared" {
+		t.Error("shared attributes are modified")
+	}
+}
+
 func TestIntegrity(t *testing.T) {
 	key := []byte("VOkJxbRl1RmTxUk/WvJxBt")
 	for _, it := range samples[:3] {
@@ -87,6 +205,44 @@ func TestIntegrity(t *testing.T) {
 	}
 }
 
+func TestCheckReadOnly(t *testing.T) {
+	d, err := hex.DecodeString(samples[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte(nil), d...)
+	m := &Message{}
+	if _, err = m.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !m.CheckIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")) || !m.CheckFingerprint() {
+				t.Error("integrity check failed")
+			}
+		}()
+	}
+	wg.Wait()
+	if !bytes.Equal(b, d) {
+		t.Error("read buffer is modified")
+	}
+
+	// UnmarshalMessage does not refer to the buffer.
+	r, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	if !bytes.Equal(r.Transaction, d[4:20]) || !r.CheckFingerprint() {
+		t.Error("message refers to the buffer")
+	}
+}
+
 func TestVectorsSampleRequest(t *testing.T) {
 	b, err := hex.DecodeString(samples[0])
 	if err != nil {
@@ -208,3 +364,133 @@ func TestNewAttr(t *testing.T) {
 		}
 	}
 }
+
+func TestTypedAttributes(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	m := &Message{Type: MethodBinding | KindError}
+	m.Add(NewAddress(AttrXorMappedAddress, ip, 32853))
+	m.Add(String(AttrUsername, "evtj:h6vY"))
+	m.Add(Int(AttrLifetime, 600))
+	m.Add(&UnknownAttributes{AttrChangeRequest, 0x0030})
+	m.Add(NewError(CodeUnknownAttribute))
+	m, err := UnmarshalMessage(m.Marshal(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("message", m)
+	if a := m.XorMappedAddress(); a == nil || !a.IP.Equal(ip) || a.Port != 32853 {
+		t.Error("wrong address:", a)
+	}
+	if v := m.Username(); v != "evtj:h6vY" {
+		t.Error("wrong username:", v)
+	}
+	if v, ok := m.Lifetime(); !ok || v != 10*time.Minute {
+		t.Error("wrong lifetime:", v)
+	}
+	if v := m.UnknownAttributes(); len(v) != 2 || v[0] != AttrChangeRequest || v[1] != 0x0030 {
+		t.Error("wrong unknown attributes:", v)
+	}
+	if err, ok := m.Get(AttrErrorCode).(*ErrorCode); !ok || err.Code != CodeUnknownAttribute {
+		t.Error("wrong error code:", err)
+	}
+}
+
+type networkCost struct {
+	id, cost uint16
+}
+
+func (*networkCost) Type() uint16 { return 0xc057 }
+
+func (a *networkCost) Marshal(p []byte) []byte {
+	r, b := grow(p, 4)
+	be.PutUint16(b, a.id)
+	be.PutUint16(b[2:], a.cost)
+	return r
+}
+
+func (a *networkCost) Unmarshal(b []byte) error {
+	if len(b) < 4 {
+		return errFormat
+	}
+	a.id, a.cost = be.Uint16(b), be.Uint16(b[2:])
+	return nil
+}
+
+func TestRegisterAttr(t *testing.T) {
+	RegisterAttr(0xc057, func() Attr { return &networkCost{} }, "NETWORK-COST")
+	t.Cleanup(func() {
+		registry.Lock()
+		delete(registry.factories, 0xc057)
+		delete(attrNames, 0xc057)
+		registry.Unlock()
+	})
+	key := []byte("VOkJxbRl1RmTxUk/WvJxBt")
+	m := &Message{Type: MethodBinding}
+	m.Add(Fingerprint)
+	m.Add(MessageIntegrity(key))
+	m.Add(&networkCost{1, 10})
+	m.Add(Bytes(0x8fff, []byte("optional")))
+	m, err := UnmarshalMessage(m.Marshal(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("message", m)
+	if v, ok := m.Get(0xc057).(*networkCost); !ok || v.id != 1 || v.cost != 10 {
+		t.Error("wrong network cost:", v)
+	}
+	if v := m.GetBytes(0x8fff); string(v) != "optional" {
+		t.Error("wrong unknown optional attribute:", v)
+	}
+	if !m.CheckIntegrity(key) || !m.CheckFingerprint() {
+		t.Error("integrity check failed")
+	}
+	if s := m.String(); !strings.Contains(s, "NETWORK-COST") {
+		t.Error("wrong string:", s)
+	}
+}
+
+func TestUnknownAttributeError(t *testing.T) {
+	m := &Message{Type: MethodBinding}
+	m.Add(String(AttrSoftware, "test"))
+	m.Add(Bytes(0x7ffe, []byte{1, 2, 3}))
+	m.Add(Bytes(0x7fff, nil))
+	_, err := UnmarshalMessage(m.Marshal(nil))
+	e, ok := err.(*UnknownAttributeError)
+	if !ok {
+		t.Fatal("wrong error:", err)
+	}
+	if len(e.Types) != 2 || e.Types[0] != 0x7ffe || e.Types[1] != 0x7fff {
+		t.Error("wrong unknown attributes:", e.Types)
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	m := &Message{Type: MethodAllocate | KindResponse}
+	m.Add(NewAddress(AttrXorRelayedAddress, net.ParseIP("192.0.2.15"), 50000))
+	m.Add(NewAddress(AttrXorRelayedAddress, net.ParseIP("2001:db8::15"), 50001))
+	m.Add(NewAddressError(IPv6, CodeInsufficientCapacity))
+	m, err := UnmarshalMessage(m.Marshal(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("message", m)
+	if r := m.XorRelayedAddresses(); len(r) != 2 || r[0].Port != 50000 || r[1].Port != 50001 {
+		t.Error("wrong relayed addresses:", r)
+	}
+	if e := m.AddressError(); e == nil || e.Family != IPv6 || e.Code != CodeInsufficientCapacity {
+		t.Error("wrong address error:", e)
+	}
+
+	req := &Message{Type: MethodAllocate}
+	req.Add(Int(AttrAdditionalAddressFamily, IPv6))
+	req, err = UnmarshalMessage(req.Marshal(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := req.GetInt(AttrAdditionalAddressFamily); !ok || v != IPv6 {
+		t.Error("wrong additional address family:", v)
+	}
+	if s := req.String(); !strings.Contains(s, "ADDITIONAL-ADDRESS-FAMILY") {
+		t.Error("wrong message:", s)
+	}
+}
@@ -0,0 +1,284 @@
+package stun
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics receives events of an agent and a server. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// MessageReceived is called for each decoded incoming message.
+	MessageReceived(msg *Message)
+	// MessageSent is called for each outgoing message.
+	MessageSent(msg *Message)
+	// MessageDropped is called for each incoming message dropped because all handler workers are busy.
+	MessageDropped(msg *Message)
+	// DecodeError is called for each incoming message which is not decoded.
+	// The typ is the type of the malformed or unknown attribute, or zero if the message itself is malformed.
+	DecodeError(typ uint16, err error)
+	// TransactionStarted is called when a request is sent for the first time.
+	TransactionStarted(req *Message)
+	// Retransmitted is called when a request is retransmitted.
+	Retransmitted(req *Message)
+	// TransactionFinished is called when a transaction is finished with the response or the error.
+	TransactionFinished(req, res *Message, rtt time.Duration, err error)
+	// HandlerQueue is called with 1 when a message starts waiting for a handler worker and with -1 when it stops.
+	// Calls may be reordered, so implementations add deltas rather than keep the last value.
+	HandlerQueue(delta int)
+}
+
+// PrometheusMetrics collects metrics and exports them in Prometheus text format as an http.Handler.
+type PrometheusMetrics struct {
+	mu           sync.Mutex
+	received     counter
+	sent         counter
+	requests     counter
+	transactions counter
+	retransmits  counter
+	decodeErrors counter
+	active       int
+	queue        int
+	rtt          histogram
+}
+
+// NewPrometheusMetrics returns empty metrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{rtt: histogram{buckets: rttBuckets}}
+}
+
+// rttBuckets contains upper bounds of transaction round-trip time histogram buckets, in seconds.
+var rttBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (p *PrometheusMetrics) MessageReceived(msg *Message) {
+	p.mu.Lock()
+	p.received.inc(methodLabel(msg), kindLabel(msg))
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) MessageSent(msg *Message) {
+	p.mu.Lock()
+	p.sent.inc(methodLabel(msg), kindLabel(msg))
+	switch msg.Kind() {
+	case KindResponse, KindError:
+		p.requests.inc(methodLabel(msg), resultLabel(msg, nil))
+	}
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) MessageDropped(msg *Message) {
+	p.mu.Lock()
+	p.requests.inc(methodLabel(msg), "dropped")
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) DecodeError(typ uint16, err error) {
+	attr := "message"
+	if typ != 0 {
+		attr = AttrName(typ)
+	}
+	p.mu.Lock()
+	p.decodeErrors.inc(attr)
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) TransactionStarted(req *Message) {
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) Retransmitted(req *Message) {
+	p.mu.Lock()
+	p.retransmits.inc(methodLabel(req))
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) TransactionFinished(req, res *Message, rtt time.Duration, err error) {
+	p.mu.Lock()
+	p.active--
+	p.transactions.inc(methodLabel(req), resultLabel(res, err))
+	if err == nil {
+		p.rtt.observe(rtt.Seconds())
+	}
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) HandlerQueue(delta int) {
+	p.mu.Lock()
+	p.queue += delta
+	p.mu.Unlock()
+}
+
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+// WriteTo writes metrics in Prometheus text format.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := &metricWriter{w: w}
+	e.counter("stun_messages_received_total", "Received STUN messages.", &p.received, "method", "kind")
+	e.counter("stun_messages_sent_total", "Sent STUN messages.", &p.sent, "method", "kind")
+	e.counter("stun_requests_total", "Served STUN requests by result.", &p.requests, "method", "result")
+	e.counter("stun_transactions_total", "Finished client transactions by result.", &p.transactions, "method", "result")
+	e.counter("stun_retransmissions_total", "Retransmitted requests.", &p.retransmits, "method")
+	e.counter("stun_decode_errors_total", "Messages which are not decoded by attribute.", &p.decodeErrors, "attribute")
+	e.gauge("stun_transactions_active", "Active client transactions.", p.active)
+	e.gauge("stun_handler_queue_length", "Messages waiting for a handler worker.", p.queue)
+	e.histogram("stun_transaction_rtt_seconds", "Transaction round-trip time.", &p.rtt)
+	return e.n, e.err
+}
+
+func methodLabel(msg *Message) string {
+	if r, ok := methodNames[msg.Method()]; ok {
+		return r
+	}
+	return "0x" + strconv.FormatUint(uint64(msg.Method()), 16)
+}
+
+func kindLabel(msg *Message) string {
+	switch msg.Kind() {
+	case KindRequest:
+		return "request"
+	case KindIndication:
+		return "indication"
+	case KindResponse:
+		return "response"
+	default:
+		return "error"
+	}
+}
+
+func resultLabel(res *Message, err error) string {
+	switch {
+	case err == errTimeout:
+		return "timeout"
+	case err != nil:
+		return "failure"
+	case res.Kind() == KindError:
+		if e := res.GetError(); e != nil {
+			return strconv.Itoa(e.Code)
+		}
+		return "error"
+	default:
+		return "success"
+	}
+}
+
+// counter is a counter vector keyed by label values joined by zero bytes.
+type counter map[string]uint64
+
+func (c *counter) inc(labels ...string) {
+	if *c == nil {
+		*c = make(counter)
+	}
+	k := ""
+	for i, it := range labels {
+		if i > 0 {
+			k += "\x00"
+		}
+		k += it
+	}
+	(*c)[k]++
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, it := range h.buckets {
+		if v <= it {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metricWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *metricWriter) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, args...)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *metricWriter) header(name, help, typ string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (e *metricWriter) counter(name, help string, c *counter, labels ...string) {
+	e.header(name, help, "counter")
+	keys := make([]string, 0, len(*c))
+	for k := range *c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.printf("%s{", name)
+		for i, v := range splitLabels(k, len(labels)) {
+			if i > 0 {
+				e.printf(",")
+			}
+			e.printf("%s=%q", labels[i], v)
+		}
+		e.printf("} %d\n", (*c)[k])
+	}
+}
+
+func (e *metricWriter) gauge(name, help string, v int) {
+	e.header(name, help, "gauge")
+	e.printf("%s %d\n", name, v)
+}
+
+func (e *metricWriter) histogram(name, help string, h *histogram) {
+	e.header(name, help, "histogram")
+	for i, it := range h.buckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		e.printf("%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(it, 'g', -1, 64), n)
+	}
+	e.printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	e.printf("%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	e.printf("%s_count %d\n", name, h.count)
+}
+
+func splitLabels(k string, n int) []string {
+	r := make([]string, 0, n)
+	for i := 0; i < n-1; i++ {
+		j := 0
+		for j < len(k) && k[j] != 0 {
+			j++
+		}
+		r = append(r, k[:j])
+		if j < len(k) {
+			k = k[j+1:]
+		} else {
+			k = ""
+		}
+	}
+	return append(r, k)
+}
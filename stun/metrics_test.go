@@ -0,0 +1,66 @@
+package stun
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	config := DefaultConfig.Clone()
+	config.Metrics = m
+	srv := NewServer(config)
+	defer srv.Close()
+	_, addr := newTestServer(t, srv)
+	conn, err := Dial("stun:"+addr.String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Request(&Message{Type: MethodBinding}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Request(&Message{Type: MethodRefresh}); err == nil {
+		t.Fatal("error expected")
+	}
+	s := httptest.NewServer(m)
+	defer s.Close()
+	res, err := s.Client().Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range []string{
+		`stun_messages_received_total{method="Binding",kind="request"} 1`,
+		`stun_messages_sent_total{method="Binding",kind="response"} 1`,
+		`stun_requests_total{method="Binding",result="success"} 1`,
+		`stun_requests_total{method="Refresh",result="400"} 1`,
+		`stun_transactions_total{method="Binding",result="success"} 1`,
+		`stun_transactions_total{method="Refresh",result="400"} 1`,
+		`stun_transactions_active 0`,
+		`stun_transaction_rtt_seconds_count 2`,
+	} {
+		if !strings.Contains(string(b), it+"\n") {
+			t.Errorf("missing %q in:\n%s", it, b)
+		}
+	}
+}
+
+func TestPrometheusHandlerQueue(t *testing.T) {
+	m := NewPrometheusMetrics()
+	// A decrement reported before the increment of another message keeps the gauge consistent.
+	for _, it := range []int{1, -1, 1, 1, -1} {
+		m.HandlerQueue(it)
+	}
+	b := &strings.Builder{}
+	m.WriteTo(b)
+	if s := b.String(); !strings.Contains(s, "stun_handler_queue_length 1\n") {
+		t.Errorf("wrong queue length in:\n%s", s)
+	}
+}
@@ -0,0 +1,48 @@
+package stun
+
+import (
+	"sync"
+)
+
+// ServeMux is a STUN message multiplexer.
+// It dispatches messages to handlers registered for the message type, i.e. method and kind.
+type ServeMux struct {
+	mu sync.RWMutex
+	h  map[uint16]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers the handler for the message type, e.g. MethodBinding | KindRequest.
+func (mux *ServeMux) Handle(typ uint16, h Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.h == nil {
+		mux.h = make(map[uint16]Handler)
+	}
+	mux.h[typ] = h
+}
+
+// HandleFunc registers the handler function for the message type.
+func (mux *ServeMux) HandleFunc(typ uint16, f func(w ResponseWriter, msg *Message)) {
+	mux.Handle(typ, HandlerFunc(f))
+}
+
+// Handler returns the handler for the message or nil if there is no registered handler.
+func (mux *ServeMux) Handler(msg *Message) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	return mux.h[msg.Type]
+}
+
+// ServeSTUN dispatches the message to the registered handler. Messages without a handler are discarded.
+func (mux *ServeMux) ServeSTUN(w ResponseWriter, msg *Message) {
+	if h := mux.Handler(msg); h != nil {
+		h.ServeSTUN(w, msg)
+	}
+}
+
+// Middleware wraps a handler, e.g. for authentication, logging or rate limiting.
+type Middleware func(h Handler) Handler
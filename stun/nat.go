@@ -11,13 +11,24 @@ const (
 	AddressPortDependent = "address-port-dependent"
 )
 
+// NAT types defined by RFC 3489.
+const (
+	OpenInternet       = "open-internet"
+	FullCone           = "full-cone"
+	RestrictedCone     = "restricted-cone"
+	PortRestrictedCone = "port-restricted-cone"
+	SymmetricNAT       = "symmetric"
+	SymmetricFirewall  = "symmetric-firewall"
+	Blocked            = "blocked"
+)
+
 type Detector struct {
 	*Conn
 }
 
 func NewDetector(c *Conn) *Detector {
 	d := &Detector{c}
-	d.agent.Handler = &Server{agent: c.agent}
+	newServer(c.agent)
 	return d
 }
 
@@ -36,14 +47,20 @@ func (d *Detector) Hairpinning() error {
 	return err
 }
 
+// DiscoverChange sends a Binding request with CHANGE-REQUEST and checks that the server honored it
+// using RESPONSE-ORIGIN, or the source address of the response if the server does not send a specified one.
 func (d *Detector) DiscoverChange(change uint64) error {
 	req := &Message{Type: MethodBinding, Attributes: []Attr{Int(AttrChangeRequest, change)}}
-	_, from, err := d.RequestTransport(req, d)
+	res, from, err := d.RequestTransport(req, d)
 	if err != nil {
 		return err
 	}
+	origin := res.GetAddr(d.Network(), AttrResponseOrigin)
+	if ip, _ := SockAddr(origin); ip == nil || ip.IsUnspecified() {
+		origin = from.RemoteAddr()
+	}
 	ip, port := SockAddr(d.RemoteAddr())
-	chip, chport := SockAddr(from.RemoteAddr())
+	chip, chport := SockAddr(origin)
 	if change&ChangeIP != 0 {
 		if ip.Equal(chip) {
 			return errors.New("stun: bad response, ip address is not changed")
@@ -81,6 +98,48 @@ func (d *Detector) Filtering() (string, error) {
 	return "", err
 }
 
+// DiscoverPadding sends a Binding request padded with PADDING to about size bytes.
+// The server pads the response the same way, so a timeout means the path drops messages of this size.
+func (d *Detector) DiscoverPadding(size int) error {
+	req := &Message{Type: MethodBinding, Attributes: d.agent.config.attrs()}
+	n := size - len(req.Marshal(nil)) - 4
+	if n < 0 {
+		n = 0
+	}
+	req = &Message{Type: MethodBinding, Attributes: []Attr{Padding(n &^ 3)}}
+	res, err := d.Request(req)
+	if err != nil {
+		return err
+	}
+	if !res.Has(AttrPadding) {
+		return errors.New("stun: bad response, no padding")
+	}
+	return nil
+}
+
+// Fragmentation reports whether fragmented UDP datagrams pass the NAT and the path in both directions.
+// It sends a Binding request padded to exceed the Ethernet MTU as defined in RFC 5780 section 7.4.
+func (d *Detector) Fragmentation() (bool, error) {
+	n := d.Network()
+	if n != "udp" {
+		return false, errors.New("stun: fragmentation test is not applicable to " + n)
+	}
+	_, err := d.Request(&Message{Type: MethodBinding})
+	if err != nil {
+		return false, err
+	}
+	switch err = d.DiscoverPadding(fragmentSize); err {
+	case nil:
+		return true, nil
+	case errTimeout:
+		return false, nil
+	}
+	return false, err
+}
+
+// fragmentSize is a message size which does not fit into a single Ethernet frame with IP and UDP headers.
+const fragmentSize = 1500
+
 func (d *Detector) DiscoverOther(addr net.Addr) (net.Addr, error) {
 	n := addr.Network()
 	conn, err := net.Dial(n, addr.String())
@@ -141,6 +200,92 @@ func (d *Detector) Mapping() (string, error) {
 	return AddressPortDependent, nil
 }
 
+// NATType runs the classic RFC 3489 NAT type discovery against an RFC 3489 server.
+// Requests are sent without the magic cookie, so old servers answer with MAPPED-ADDRESS and CHANGED-ADDRESS.
+func (d *Detector) NATType() (string, error) {
+	n := d.Network()
+	if n != "udp" {
+		return "", errors.New("stun: NAT type discovery is not applicable to " + n)
+	}
+	res, err := d.classicRequest(0, d)
+	switch err {
+	case nil:
+	case errTimeout:
+		return Blocked, nil
+	default:
+		return "", err
+	}
+	mapped, changed := res.GetAddr(n, AttrMappedAddress), res.GetAddr(n, AttrChangedAddress)
+	if mapped == nil {
+		return "", errors.New("stun: bad response, no mapped address")
+	}
+	if changed == nil {
+		return "", errors.New("stun: bad response, no changed address")
+	}
+	_, err = d.classicRequest(ChangeIP|ChangePort, d)
+	if isLocalAddr(mapped, d.LocalAddr()) {
+		switch err {
+		case nil:
+			return OpenInternet, nil
+		case errTimeout:
+			return SymmetricFirewall, nil
+		}
+		return "", err
+	}
+	switch err {
+	case nil:
+		return FullCone, nil
+	case errTimeout:
+	default:
+		return "", err
+	}
+	c, ok := d.Conn.Conn.(*packetConn)
+	if !ok {
+		return "", errors.New("stun: NAT type discovery requires a packet connection")
+	}
+	res, err = d.classicRequest(0, &packetConn{c.PacketConn, changed})
+	if err != nil {
+		return "", err
+	}
+	if !sameAddr(mapped, res.GetAddr(n, AttrMappedAddress)) {
+		return SymmetricNAT, nil
+	}
+	_, err = d.classicRequest(ChangePort, d)
+	switch err {
+	case nil:
+		return RestrictedCone, nil
+	case errTimeout:
+		return PortRestrictedCone, nil
+	}
+	return "", err
+}
+
+func (d *Detector) classicRequest(change uint64, to Transport) (*Message, error) {
+	req := &Message{Type: MethodBinding, Transaction: NewClassicTransaction()}
+	if change != 0 {
+		req.Add(Int(AttrChangeRequest, change))
+	}
+	res, _, err := d.RequestTransport(req, to)
+	return res, err
+}
+
+// isLocalAddr reports whether the mapped address is the local address, i.e. there is no NAT.
+func isLocalAddr(mapped, laddr net.Addr) bool {
+	ip, port := SockAddr(mapped)
+	if _, lport := SockAddr(laddr); port != lport {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, it := range local {
+		if it.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func LocalAddrs() []*net.IPAddr {
 	return local
 }
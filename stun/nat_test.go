@@ -1,13 +1,64 @@
 package stun
 
 import (
+	"errors"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 )
 
-var once sync.Once
+var (
+	once    sync.Once
+	natAddr string
+	natErr  error
+)
+
+var errNoAlternate = errors.New("no local IPv4 address to use as the alternate address")
+
+// startRFC5780Server starts an RFC 5780 server on the loopback and a local IPv4 address on free ports
+// and returns the primary address.
+func startRFC5780Server(config *Config) (string, error) {
+	var alternate net.IP
+	for _, it := range local {
+		if it.IP.To4() != nil {
+			alternate = it.IP
+			break
+		}
+	}
+	if alternate == nil {
+		return "", errNoAlternate
+	}
+	primary := net.IPv4(127, 0, 0, 1)
+	var err error
+	for i := 0; i < 10; i++ {
+		var ports []int
+		for len(ports) < 2 {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: primary})
+			if err != nil {
+				return "", err
+			}
+			ports = append(ports, c.LocalAddr().(*net.UDPAddr).Port)
+			c.Close()
+		}
+		if ports[0] == ports[1] {
+			continue
+		}
+		srv := NewServer(config)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- srv.ListenAndServeRFC5780(primary.String(), alternate.String(), ports[0], ports[1])
+		}()
+		// Listen errors are returned at once, so a running server is assumed after a while.
+		select {
+		case err = <-errc:
+		case <-time.After(200 * time.Millisecond):
+			return net.JoinHostPort(primary.String(), strconv.Itoa(ports[0])), nil
+		}
+	}
+	return "", err
+}
 
 func newDetector(t *testing.T) *Detector {
 	config := DefaultConfig.Clone()
@@ -22,17 +73,16 @@ func newDetector(t *testing.T) *Detector {
 	once.Do(func() {
 		c := config.Clone()
 		c.Software = "server"
-
-		srv := NewServer(c)
-		loop, _ := net.ResolveIPAddr("ip", "localhost")
-		for _, it := range append(local, loop) {
-			for _, port := range []string{"3478", "3479"} {
-				go srv.ListenAndServe("udp", net.JoinHostPort(it.IP.String(), port))
-			}
-		}
-		time.Sleep(time.Second)
+		natAddr, natErr = startRFC5780Server(c)
 	})
-	c, err := Dial("stun:localhost", config)
+	switch natErr {
+	case nil:
+	case errNoAlternate:
+		t.Skip(natErr)
+	default:
+		t.Fatal(natErr)
+	}
+	c, err := Dial("stun:"+natAddr, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,3 +121,27 @@ func TestMapping(t *testing.T) {
 	}
 	t.Logf("mapping: %v", v)
 }
+
+func TestNATType(t *testing.T) {
+	d := newDetector(t)
+	v, err := d.NATType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != OpenInternet {
+		t.Errorf("Wrong NAT type: %v", v)
+	}
+	t.Logf("NAT type: %v", v)
+}
+
+func TestFragmentation(t *testing.T) {
+	d := newDetector(t)
+	v, err := d.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v {
+		t.Error("Fragmented messages are dropped")
+	}
+	t.Logf("fragmentation: %v", v)
+}
@@ -0,0 +1,175 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// passBacklog is the number of passed through datagrams kept until they are read.
+const passBacklog = 64
+
+// maxDatagramSize is the size of the buffer the shared socket is read into, so that passed through datagrams
+// are not truncated.
+const maxDatagramSize = 1 << 16
+
+var errNotPacketConn = errors.New("stun: not a packet connection")
+
+// datagram is a passed through datagram.
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// passConn is a net.PacketConn sharing the socket with an agent.
+// Responses of pending transactions are served by the agent, other datagrams are passed to ReadFrom.
+// Datagrams are dropped if the reader does not keep up.
+type passConn struct {
+	net.PacketConn
+	close func() error
+	in    chan datagram
+	done  chan struct{}
+	once  sync.Once
+	err   error
+	rd    deadline
+}
+
+func newPassConn(c net.PacketConn, close func() error) *passConn {
+	return &passConn{
+		PacketConn: c,
+		close:      close,
+		in:         make(chan datagram, passBacklog),
+		done:       make(chan struct{}),
+		rd:         deadline{c: make(chan struct{})},
+	}
+}
+
+// pass queues a copy of the datagram, unless the reader does not keep up.
+func (c *passConn) pass(b []byte, addr net.Addr) {
+	select {
+	case c.in <- datagram{append([]byte(nil), b...), addr}:
+	default:
+	}
+}
+
+// shutdown fails pending and subsequent reads with the error the socket was closed or broken with.
+func (c *passConn) shutdown(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+func (c *passConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case d := <-c.in:
+		return copy(p, d.b), d.addr, nil
+	default:
+	}
+	select {
+	case d := <-c.in:
+		return copy(p, d.b), d.addr, nil
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Addr: c.LocalAddr(), Err: c.err}
+	case <-c.rd.wait():
+		return 0, nil, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Addr: c.LocalAddr(), Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// Close closes the socket and the agent serving it.
+func (c *passConn) Close() error {
+	return c.close()
+}
+
+func (c *passConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom only, the agent keeps reading the socket.
+func (c *passConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// deadline is closed once the time is reached, so pending reads are interrupted when the deadline changes.
+type deadline struct {
+	mu sync.Mutex
+	t  *time.Timer
+	c  chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.t != nil && !d.t.Stop() {
+		// The timer fired, wait for the channel to be closed.
+		<-d.c
+	}
+	d.t = nil
+	closed := false
+	select {
+	case <-d.c:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.c = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.c = make(chan struct{})
+		}
+		c := d.c
+		d.t = time.AfterFunc(dur, func() { close(c) })
+		return
+	}
+	if !closed {
+		close(d.c)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.c
+}
+
+// pending reports whether the datagram is a response of a pending transaction.
+func (m *mux) pending(b []byte) bool {
+	if len(b) < 20 || b[0]&0xc0 != 0 || b[0]&0x01 == 0 {
+		return false
+	}
+	m.RLock()
+	_, ok := m.t[string(b[4:20])]
+	m.RUnlock()
+	return ok
+}
+
+// servePacket serves the socket like Agent.ServePacket, passing datagrams other than responses of pending
+// transactions through once the pass through connection is set.
+func (a *Agent) servePacket(c net.PacketConn, pass func() *passConn) error {
+	b := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			if p := pass(); p != nil {
+				p.shutdown(err)
+			}
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if p := pass(); p != nil && !a.m.pending(b[:n]) {
+			p.pass(b[:n], addr)
+			continue
+		}
+		a.ServeTransport(b[:n], &packetConn{c, addr})
+	}
+}
@@ -0,0 +1,113 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnPacketConn(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+	c, err := conn.PacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Non-STUN datagrams are passed through, while transactions keep working.
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.LocalAddr().(*net.UDPAddr).Port}
+	if _, err = peer.WriteTo([]byte("media"), to); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 100)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "media" || !sameAddr(addr, peer.LocalAddr()) {
+		t.Errorf("wrong datagram: %q from %v", b[:n], addr)
+	}
+	if _, err = c.WriteTo([]byte("reply"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err = peer.ReadFrom(b); err != nil || string(b[:n]) != "reply" {
+		t.Errorf("wrong reply: %q, %v", b[:n], err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = c.ReadFrom(b); err == nil || !err.(net.Error).Timeout() {
+		t.Error("expected timeout:", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	go c.Close()
+	if _, _, err = c.ReadFrom(b); err == nil {
+		t.Error("expected error after close")
+	}
+	if _, err = conn.Discover(); err == nil {
+		t.Error("expected error after close")
+	}
+}
+
+func TestConnPacketConnLarge(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+	c, err := conn.PacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Datagrams larger than the buffers of STUN messages are passed through whole.
+	p := make([]byte, 4000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.LocalAddr().(*net.UDPAddr).Port}
+	if _, err = peer.WriteTo(p, to); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8000)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], p) {
+		t.Errorf("wrong datagram of %d bytes", n)
+	}
+}
+
+func TestConnPacketConnTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := DialURI(&URI{Scheme: "stun", Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, Transport: "tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.PacketConn(); err != errNotPacketConn {
+		t.Error("wrong error:", err)
+	}
+}
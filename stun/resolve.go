@@ -0,0 +1,218 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver looks up DNS records of servers. DNSResolver is the default implementation,
+// tests and applications may provide their own, e.g. a fake DNS.
+type Resolver interface {
+	// LookupSRV looks up SRV records of the service, proto and name as net.Resolver does.
+	// Dial passes empty service and proto and the full name, e.g. "_stun._udp.example.org".
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	// LookupNAPTR looks up NAPTR records of the name. It returns no records and no error if the name has none.
+	LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error)
+	// LookupIPAddr looks up IP addresses of the host.
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NAPTR is a DNS NAPTR record as defined in RFC 3403.
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// DefaultResolver is used by Dial if Config.Resolver is nil.
+var DefaultResolver Resolver = &DNSResolver{}
+
+// Endpoint is a transport address of a server resolved from a URI.
+type Endpoint struct {
+	// Network is udp or tcp
+	Network string
+	IP      net.IP
+	Port    int
+}
+
+func (e *Endpoint) Addr() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+func (e *Endpoint) String() string {
+	return e.Network + "/" + e.Addr()
+}
+
+// Resolve returns transport addresses of the URI in the order they should be tried.
+// If the URI has no port and the host is not an IP address, servers are discovered using DNS as defined
+// in RFC 5389 section 9 and, for TURN URIs without transport, RFC 5928: NAPTR records select the transport
+// and SRV records select targets by priority and weight. Otherwise, or if there are no records or the lookup fails,
+// addresses of the host with the default port are returned. It fails if SRV records tell the service is not available.
+// Addresses of targets of the same SRV priority alternate address families as recommended by RFC 8305, see DialURI.
+func Resolve(ctx context.Context, r Resolver, u *URI) ([]*Endpoint, error) {
+	if r == nil {
+		r = DefaultResolver
+	}
+	if ip := net.ParseIP(u.Host); ip != nil {
+		return []*Endpoint{{u.Network(), ip, portOrDefault(u)}}, nil
+	}
+	var targets []*target
+	if u.Port == 0 {
+		var err error
+		if targets, err = lookupTargets(ctx, r, u); err != nil {
+			return nil, err
+		}
+	}
+	if len(targets) == 0 {
+		targets = []*target{{u.Network(), u.Host, portOrDefault(u), 0}}
+	}
+	var (
+		r2, group []*Endpoint
+		lastErr   error
+	)
+	for i, t := range targets {
+		if i > 0 && t.group != targets[i-1].group {
+			r2, group = append(r2, interleave(group)...), nil
+		}
+		ips, err := r.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			group = append(group, &Endpoint{t.network, ip.IP, t.port})
+		}
+	}
+	r2 = append(r2, interleave(group)...)
+	if len(r2) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("stun: no addresses of " + u.Host)
+		}
+		return nil, lastErr
+	}
+	return r2, nil
+}
+
+type target struct {
+	network string
+	host    string
+	port    int
+	// group numbers targets of the same SRV name and priority
+	group int
+}
+
+func portOrDefault(u *URI) int {
+	if u.Port != 0 {
+		return u.Port
+	}
+	return u.defaultPort()
+}
+
+// naptrServices maps RFC 5928 NAPTR services to transports of TURN schemes.
+var naptrServices = map[string]map[string]string{
+	"turn":  {"RELAY:turn.udp": "udp", "RELAY:turn.tcp": "tcp"},
+	"turns": {"RELAY:turn.tls": "tcp"},
+}
+
+// lookupTargets returns targets of SRV records, selecting the SRV names using NAPTR records if applicable.
+// Lookup errors are ignored, so the host is used with the default port if no SRV record is found.
+// It returns an error if the only SRV target is "." and no other SRV name has targets.
+func lookupTargets(ctx context.Context, r Resolver, u *URI) ([]*target, error) {
+	type srvName struct {
+		network, name string
+	}
+	var names []srvName
+	if services := naptrServices[u.Scheme]; services != nil && u.Transport == "" {
+		// Lookup errors are not fatal, SRV records are used as if there are no NAPTR records.
+		records, _ := r.LookupNAPTR(ctx, u.Host)
+		sort.SliceStable(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			return a.Order < b.Order || a.Order == b.Order && a.Preference < b.Preference
+		})
+		for _, it := range records {
+			if n, ok := services[it.Service]; ok && strings.EqualFold(it.Flags, "s") && it.Replacement != "" {
+				names = append(names, srvName{n, it.Replacement})
+			}
+		}
+	}
+	if names == nil {
+		names = []srvName{{u.Network(), "_" + u.Scheme + "._" + u.Network() + "." + u.Host}}
+		if u.Scheme == "turn" && u.Transport == "" {
+			// RFC 5928 section 4: without NAPTR records, UDP is tried first and then TCP.
+			names = append(names, srvName{"tcp", "_turn._tcp." + u.Host})
+		}
+	}
+	var (
+		targets     []*target
+		unavailable bool
+		group       int
+	)
+	for _, it := range names {
+		_, addrs, err := r.LookupSRV(ctx, "", "", it.name)
+		if err != nil {
+			// RFC 5389 section 9: SRV lookup failures fall back to A and AAAA records.
+			continue
+		}
+		addrs = orderSRV(addrs)
+		for i, a := range addrs {
+			if i == 0 || a.Priority != addrs[i-1].Priority {
+				group++
+			}
+			host := strings.TrimSuffix(a.Target, ".")
+			if host == "" {
+				// RFC 2782: the service is decidedly not available.
+				unavailable = true
+				continue
+			}
+			targets = append(targets, &target{it.network, host, int(a.Port), group})
+		}
+	}
+	if len(targets) == 0 && unavailable {
+		return nil, errors.New("stun: service is not available at " + u.Host)
+	}
+	return targets, nil
+}
+
+// orderSRV orders records by priority and randomly by weight within a priority as defined in RFC 2782.
+func orderSRV(addrs []*net.SRV) []*net.SRV {
+	addrs = append([]*net.SRV(nil), addrs...)
+	sort.SliceStable(addrs, func(i, j int) bool { return addrs[i].Priority < addrs[j].Priority })
+	for i := 0; i < len(addrs); {
+		j := i + 1
+		for j < len(addrs) && addrs[j].Priority == addrs[i].Priority {
+			j++
+		}
+		shuffleSRV(addrs[i:j])
+		i = j
+	}
+	return addrs
+}
+
+func shuffleSRV(addrs []*net.SRV) {
+	sum := 0
+	for _, it := range addrs {
+		sum += int(it.Weight)
+	}
+	for sum > 0 && len(addrs) > 1 {
+		s, n := 0, rand.Intn(sum+1)
+		for i, it := range addrs {
+			s += int(it.Weight)
+			if s >= n {
+				if i > 0 {
+					addrs[0], addrs[i] = addrs[i], addrs[0]
+				}
+				break
+			}
+		}
+		sum -= int(addrs[0].Weight)
+		addrs = addrs[1:]
+	}
+}
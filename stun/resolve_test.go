@@ -0,0 +1,207 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type fakeResolver struct {
+	srv    map[string][]*net.SRV
+	srvErr map[string]error
+	naptr  map[string][]*NAPTR
+	hosts  map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if err, ok := r.srvErr[name]; ok {
+		return "", nil, err
+	}
+	if a, ok := r.srv[name]; ok {
+		return name, a, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	return r.naptr[name], nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if a, ok := r.hosts[host]; ok {
+		return a, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func ipAddrs(s ...string) []net.IPAddr {
+	var r []net.IPAddr
+	for _, it := range s {
+		r = append(r, net.IPAddr{IP: net.ParseIP(it)})
+	}
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_stun._udp.example.org": {
+				{Target: "b.example.org.", Port: 3479, Priority: 20, Weight: 0},
+				{Target: "a.example.org.", Port: 3478, Priority: 10, Weight: 5},
+			},
+			"_turn._tcp.example.org":  {{Target: "a.example.org.", Port: 443, Priority: 10}},
+			"_turn._udp.example.org":  {{Target: "b.example.org.", Port: 3478, Priority: 10}},
+			"_stuns._tcp.example.com": {{Target: ".", Port: 5349}},
+			"_stun._udp.example.edu": {
+				{Target: "c.example.edu.", Port: 3478, Priority: 10},
+				{Target: "d.example.edu.", Port: 3478, Priority: 20},
+			},
+		},
+		srvErr: map[string]error{
+			"_stun._udp.example.net": &net.DNSError{Err: "server misbehaving", Name: "_stun._udp.example.net", IsTemporary: true},
+		},
+		naptr: map[string][]*NAPTR{
+			"example.org": {
+				{Order: 20, Flags: "s", Service: "RELAY:turn.udp", Replacement: "_turn._udp.example.org"},
+				{Order: 10, Flags: "s", Service: "RELAY:turn.tcp", Replacement: "_turn._tcp.example.org"},
+				{Order: 5, Flags: "s", Service: "RELAY:turn.dtls", Replacement: "_turns._udp.example.org"},
+			},
+		},
+		hosts: map[string][]net.IPAddr{
+			"a.example.org": ipAddrs("192.0.2.1", "2001:db8::1"),
+			"b.example.org": ipAddrs("192.0.2.2"),
+			"example.org":   ipAddrs("192.0.2.3"),
+			"example.com":   ipAddrs("192.0.2.4"),
+			"example.net":   ipAddrs("192.0.2.5"),
+			"c.example.edu": ipAddrs("192.0.2.6", "192.0.2.7"),
+			"d.example.edu": ipAddrs("2001:db8::8"),
+			"example.info":  ipAddrs("2001:db8::9", "2001:db8::a", "192.0.2.9"),
+		},
+	}
+	for _, it := range []struct {
+		uri       string
+		endpoints []string
+	}{
+		{"stun:example.org", []string{"udp/192.0.2.1:3478", "udp/[2001:db8::1]:3478", "udp/192.0.2.2:3479"}},
+		{"stun:example.org:3478", []string{"udp/192.0.2.3:3478"}},
+		{"stun:192.0.2.9", []string{"udp/192.0.2.9:3478"}},
+		{"turn:example.org", []string{"tcp/192.0.2.1:443", "tcp/[2001:db8::1]:443", "udp/192.0.2.2:3478"}},
+		{"turn:example.org?transport=udp", []string{"udp/192.0.2.2:3478"}},
+		{"stuns:example.com", nil},
+		{"turns:example.com", []string{"tcp/192.0.2.4:5349"}},
+		{"stun:example.net", []string{"udp/192.0.2.5:3478"}},
+		// Address families alternate within a priority only.
+		{"stun:example.edu", []string{"udp/192.0.2.6:3478", "udp/192.0.2.7:3478", "udp/[2001:db8::8]:3478"}},
+		{"stun:example.info", []string{"udp/[2001:db8::9]:3478", "udp/192.0.2.9:3478", "udp/[2001:db8::a]:3478"}},
+	} {
+		u, err := ParseURI(it.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := Resolve(context.Background(), r, u)
+		if it.endpoints == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", it.uri)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", it.uri, err)
+			continue
+		}
+		var s []string
+		for _, it := range e {
+			s = append(s, it.String())
+		}
+		if !reflect.DeepEqual(s, it.endpoints) {
+			t.Errorf("%s: wrong endpoints %v", it.uri, s)
+		}
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	addrs := []*net.SRV{
+		{Target: "c", Priority: 2, Weight: 10},
+		{Target: "a", Priority: 1, Weight: 0},
+		{Target: "b", Priority: 1, Weight: 100},
+	}
+	first := 0
+	for i := 0; i < 100; i++ {
+		r := orderSRV(addrs)
+		if r[2].Target != "c" {
+			t.Fatal("wrong priority order")
+		}
+		if r[0].Target == "b" {
+			first++
+		}
+	}
+	if first < 90 {
+		t.Errorf("weight is ignored, %d of 100", first)
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(l)
+	// A closed port
+	c, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	config := DefaultConfig.Clone()
+	config.Resolver = &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_stun._tcp.example.org": {
+				{Target: "down.example.org.", Port: uint16(c.Addr().(*net.TCPAddr).Port), Priority: 1},
+				{Target: "up.example.org.", Port: uint16(l.Addr().(*net.TCPAddr).Port), Priority: 2},
+			},
+		},
+		hosts: map[string][]net.IPAddr{
+			"down.example.org": ipAddrs("127.0.0.1"),
+			"up.example.org":   ipAddrs("127.0.0.1"),
+		},
+	}
+	conn, err := DialURI(&URI{Scheme: "stun", Host: "example.org", Transport: "tcp"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Discover(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseNAPTR(t *testing.T) {
+	q, id, err := newDNSQuery("example.org", dnsTypeNAPTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte(nil), q...)
+	b[2], b[3], b[7] = 0x81, 0x80, 1
+	rdata := []byte{0, 10, 0, 20, 1, 's', 14}
+	rdata = append(rdata, "RELAY:turn.udp"...)
+	rdata = append(rdata, 0, 10)
+	rdata = append(rdata, "_turn._udp"...)
+	rdata = append(rdata, 0xc0, 12)
+	b = append(b, 0xc0, 12, 0, dnsTypeNAPTR, 0, dnsClassIN, 0, 0, 0, 60, 0, byte(len(rdata)))
+	b = append(b, rdata...)
+	r, err := parseNAPTR(b, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &NAPTR{Order: 10, Preference: 20, Flags: "s", Service: "RELAY:turn.udp", Replacement: "_turn._udp.example.org"}
+	if len(r) != 1 || !reflect.DeepEqual(r[0], expected) {
+		t.Errorf("wrong records: %+v", r)
+	}
+	if _, err = parseNAPTR(b[:len(b)-3], id); err == nil {
+		t.Error("truncated response is accepted")
+	}
+}
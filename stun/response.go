@@ -0,0 +1,96 @@
+package stun
+
+import (
+	"errors"
+)
+
+// ResponseWriter is used by a Handler to answer a request.
+// Responses have the transaction ID of the request and the SOFTWARE and FINGERPRINT attributes
+// configured by the agent. If the request has FINGERPRINT, the response has it too.
+type ResponseWriter interface {
+	// Transport returns the transport the response is sent to, by default the one the request was received from.
+	Transport() Transport
+	// SetTransport replaces the transport the response is sent to, e.g. to reply from a different socket.
+	SetTransport(tr Transport)
+	// SetSession sets the session of the request. If the session has a key, responses have MESSAGE-INTEGRITY.
+	SetSession(sess *Session)
+	// Success sends a success response with the attributes.
+	Success(attrs ...Attr) error
+	// Error sends an error response with the error code and the attributes.
+	Error(code int, attrs ...Attr) error
+}
+
+type responseWriter struct {
+	agent *Agent
+	req   *Message
+	tr    Transport
+	sess  *Session
+}
+
+func (w *responseWriter) Transport() Transport        { return w.tr }
+func (w *responseWriter) SetTransport(tr Transport)   { w.tr = tr }
+func (w *responseWriter) SetSession(sess *Session)    { w.sess = sess }
+func (w *responseWriter) Success(attrs ...Attr) error { return w.send(KindResponse, attrs) }
+
+func (w *responseWriter) Error(code int, attrs ...Attr) error {
+	return w.send(KindError, append([]Attr{NewError(code)}, attrs...))
+}
+
+func (w *responseWriter) send(kind uint16, attrs []Attr) error {
+	config := w.agent.config
+	res := &Message{
+		Type:        w.req.Method() | kind,
+		Transaction: w.req.Transaction,
+		Attributes:  append(config.attrs(), attrs...),
+	}
+	auth := w.sess != nil && w.sess.Key != nil
+	if auth {
+		res.Add(MessageIntegrity(w.sess.Key))
+	}
+	if w.req.Has(AttrFingerprint) && !config.Fingerprint {
+		res.Add(Fingerprint)
+	}
+	if config.LimitResponseSize && !auth && !limitSize(res, requestSize(w.req)) {
+		return errResponseTooLarge
+	}
+	return w.agent.write(res, w.tr)
+}
+
+// optionalAttrs contains attributes omitted from responses to fit the size limit, in order.
+var optionalAttrs = []uint16{
+	AttrPadding,
+	AttrSoftware,
+	AttrOtherAddress,
+	AttrResponseOrigin,
+	AttrMappedAddress,
+	AttrFingerprint,
+}
+
+// limitSize omits optional attributes until the message fits n bytes.
+// It reports whether the message fits, so a reflected response does not amplify the request.
+func limitSize(msg *Message, n int) bool {
+	for _, typ := range optionalAttrs {
+		if messageSize(msg) <= n {
+			return true
+		}
+		msg.Del(typ)
+	}
+	return messageSize(msg) <= n
+}
+
+// requestSize returns the length of the received request, or of the encoded one if it is not decoded.
+func requestSize(msg *Message) int {
+	if msg.size > 0 {
+		return msg.size
+	}
+	return messageSize(msg)
+}
+
+func messageSize(msg *Message) int {
+	b := msg.Marshal(getBuffer()[:0])
+	n := len(b)
+	putBuffer(b)
+	return n
+}
+
+var errResponseTooLarge = errors.New("stun: response is larger than request")
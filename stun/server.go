@@ -1,6 +1,8 @@
 package stun
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
 )
@@ -12,88 +14,276 @@ func ListenAndServe(network, laddr string, config *Config) error {
 
 type Server struct {
 	agent *Agent
+	mux   *ServeMux
 
-	mu    sync.RWMutex
-	conns []net.PacketConn
+	mu        sync.RWMutex
+	conns     []net.PacketConn
+	listeners []net.Listener
+	streams   map[net.Conn]struct{}
+	handler   Handler
+
+	// handlers counts running handlers, new messages are not handled once shutdown is set
+	handlers sync.WaitGroup
+	shutdown bool
 }
 
 func NewServer(config *Config) *Server {
-	srv := &Server{agent: NewAgent(config)}
-	srv.agent.Handler = srv
+	return newServer(NewAgent(config))
+}
+
+func newServer(a *Agent) *Server {
+	srv := &Server{agent: a, mux: NewServeMux()}
+	srv.handler = HandlerFunc(srv.serve)
+	srv.mux.HandleFunc(MethodBinding|KindRequest, srv.serveBinding)
+	a.Handler = srv
 	return srv
 }
 
+// Handle registers the handler for the message type, e.g. MethodAllocate | KindRequest.
+// It replaces the built-in Binding request handler if the type is MethodBinding | KindRequest.
+func (srv *Server) Handle(typ uint16, h Handler) {
+	srv.mux.Handle(typ, h)
+}
+
+// HandleFunc registers the handler function for the message type.
+func (srv *Server) HandleFunc(typ uint16, f func(w ResponseWriter, msg *Message)) {
+	srv.mux.HandleFunc(typ, f)
+}
+
+// Use wraps message handling with the middleware. The last added middleware is called first.
+func (srv *Server) Use(mw ...Middleware) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, it := range mw {
+		srv.handler = it(srv.handler)
+	}
+}
+
+// ListenAndServe listens on the UDP or TCP address and serves STUN messages.
 func (srv *Server) ListenAndServe(network, laddr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(network, laddr)
+		if err != nil {
+			return err
+		}
+		return srv.ServeListener(l)
+	}
 	c, err := net.ListenPacket(network, laddr)
 	if err != nil {
 		return err
 	}
+	return srv.Serve(c)
+}
+
+// ListenAndServeRFC5780 listens on UDP addresses combined from the primary and alternate IP addresses and ports,
+// so the server is able to answer CHANGE-REQUEST and populate OTHER-ADDRESS as defined by RFC 5780.
+// If any of the four listeners fails, the others are closed.
+func (srv *Server) ListenAndServeRFC5780(primaryIP, alternateIP string, port, altPort int) error {
+	primary, alternate := net.ParseIP(primaryIP), net.ParseIP(alternateIP)
+	switch {
+	case primary == nil:
+		return errors.New("stun: invalid primary IP address: " + primaryIP)
+	case alternate == nil:
+		return errors.New("stun: RFC 5780 requires an alternate IP address, invalid: " + alternateIP)
+	case primary.IsUnspecified() || alternate.IsUnspecified():
+		return errors.New("stun: RFC 5780 requires specified IP addresses")
+	case primary.Equal(alternate):
+		return errors.New("stun: RFC 5780 requires two different IP addresses, got only " + primaryIP)
+	case (primary.To4() == nil) != (alternate.To4() == nil):
+		return errors.New("stun: primary and alternate IP addresses must be of the same family")
+	case port == altPort:
+		return errors.New("stun: RFC 5780 requires two different ports")
+	}
+	var conns []net.PacketConn
+	for _, ip := range []net.IP{primary, alternate} {
+		for _, p := range []int{port, altPort} {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: p})
+			if err != nil {
+				for _, it := range conns {
+					it.Close()
+				}
+				return err
+			}
+			conns = append(conns, c)
+		}
+	}
+	errc := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c net.PacketConn) {
+			errc <- srv.Serve(c)
+		}(c)
+	}
+	err := <-errc
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+// Serve accepts incoming STUN messages on the packet connection c.
+func (srv *Server) Serve(c net.PacketConn) error {
 	srv.addConn(c)
 	defer srv.removeConn(c)
 	return srv.agent.ServePacket(c)
 }
 
-func (srv *Server) ServeSTUN(msg *Message, from Transport) {
-	if msg.Type == MethodBinding {
-		to := from
-		mapped := from.RemoteAddr()
-		ip, port := SockAddr(from.LocalAddr())
-
-		res := &Message{
-			Type:        MethodBinding | KindResponse,
-			Transaction: msg.Transaction,
-			Attributes: []Attr{
-				Addr(AttrXorMappedAddress, mapped),
-				Addr(AttrMappedAddress, mapped),
-			},
+// ServeListener accepts stream connections, e.g. TCP or TLS, and serves STUN messages on them.
+func (srv *Server) ServeListener(l net.Listener) error {
+	srv.mu.Lock()
+	srv.listeners = append(srv.listeners, l)
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		for i, it := range srv.listeners {
+			if it == l {
+				srv.listeners = append(srv.listeners[:i], srv.listeners[i+1:]...)
+				break
+			}
 		}
+		srv.mu.Unlock()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(c)
+	}
+}
+
+func (srv *Server) serveConn(c net.Conn) {
+	srv.mu.Lock()
+	if srv.streams == nil {
+		srv.streams = make(map[net.Conn]struct{})
+	}
+	srv.streams[c] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.streams, c)
+		srv.mu.Unlock()
+		c.Close()
+	}()
+	srv.agent.ServeConn(c)
+}
+
+func (srv *Server) ServeSTUN(w ResponseWriter, msg *Message) {
+	srv.mu.RLock()
+	if srv.shutdown {
+		srv.mu.RUnlock()
+		return
+	}
+	srv.handlers.Add(1)
+	h := srv.handler
+	srv.mu.RUnlock()
+	defer srv.handlers.Done()
+	h.ServeSTUN(w, msg)
+}
+
+// serve dispatches the message to the registered handler and answers unsupported requests with 400 (Bad Request).
+// Requests with unknown comprehension-required attributes are answered with 420 (Unknown Attribute).
+func (srv *Server) serve(w ResponseWriter, msg *Message) {
+	if msg.unknown != nil {
+		types := UnknownAttributes(msg.unknown)
+		w.Error(CodeUnknownAttribute, &types)
+		return
+	}
+	if h := srv.mux.Handler(msg); h != nil {
+		h.ServeSTUN(w, msg)
+		return
+	}
+	if msg.Kind() == KindRequest {
+		w.Error(CodeBadRequest)
+	}
+}
 
-		srv.mu.RLock()
-		defer srv.mu.RUnlock()
+func (srv *Server) serveBinding(w ResponseWriter, msg *Message) {
+	from := w.Transport()
+	to := from
+	mapped := from.RemoteAddr()
+	ip, port := SockAddr(from.LocalAddr())
 
-		if ch, ok := msg.GetInt(AttrChangeRequest); ok && ch != 0 {
-			for _, c := range srv.conns {
-				chip, chport := SockAddr(c.LocalAddr())
-				if chip.IsUnspecified() {
-					continue
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	if ch, ok := msg.ChangeRequest(); ok && ch != 0 {
+		for _, c := range srv.conns {
+			chip, chport := SockAddr(c.LocalAddr())
+			if chip.IsUnspecified() {
+				continue
+			}
+			if ch&ChangeIP != 0 {
+				if !ip.Equal(chip) {
+					to = &packetConn{c, mapped}
+					break
 				}
-				if ch&ChangeIP != 0 {
-					if !ip.Equal(chip) {
-						to = &packetConn{c, mapped}
-						break
-					}
-				} else if ch&ChangePort != 0 {
-					if ip.Equal(chip) && port != chport {
-						to = &packetConn{c, mapped}
-						break
-					}
+			} else if ch&ChangePort != 0 {
+				if ip.Equal(chip) && port != chport {
+					to = &packetConn{c, mapped}
+					break
 				}
 			}
 		}
+	}
 
-		if len(srv.conns) < 2 {
-			srv.agent.Send(res, to)
-			return
+	var attrs []Attr
+	other := srv.otherAddr(ip, port)
+	// The destination address of requests to a wildcard socket is unknown, so the origin is not sent.
+	origin := to.LocalAddr()
+	if oip, _ := SockAddr(origin); oip == nil || oip.IsUnspecified() {
+		origin = nil
+	}
+
+	if msg.Classic() {
+		// RFC 3489 clients do not understand XOR-MAPPED-ADDRESS.
+		attrs = append(attrs, Addr(AttrMappedAddress, mapped))
+		if origin != nil {
+			attrs = append(attrs, Addr(AttrSourceAddress, origin))
+		}
+		if other != nil {
+			attrs = append(attrs, Addr(AttrChangedAddress, other))
 		}
+	} else {
+		attrs = append(attrs,
+			Addr(AttrXorMappedAddress, mapped),
+			Addr(AttrMappedAddress, mapped),
+		)
+		if origin != nil {
+			attrs = append(attrs, Addr(AttrResponseOrigin, origin))
+		}
+		if other != nil {
+			attrs = append(attrs, Addr(AttrOtherAddress, other))
+		}
+		// RFC 5780 section 7.4: pad the response the same way as the request.
+		if p := msg.GetBytes(AttrPadding); p != nil && !msg.Has(AttrResponsePort) {
+			attrs = append(attrs, Padding(len(p)))
+		}
+	}
 
-	other:
-		for _, a := range srv.conns {
-			aip, aport := SockAddr(a.LocalAddr())
-			if aip.IsUnspecified() || !ip.Equal(aip) || port == aport {
+	w.SetTransport(to)
+	w.Success(attrs...)
+}
+
+// otherAddr returns the address of the connection with both IP address and port different from the given ones.
+func (srv *Server) otherAddr(ip net.IP, port int) net.Addr {
+	if len(srv.conns) < 2 {
+		return nil
+	}
+	for _, a := range srv.conns {
+		aip, aport := SockAddr(a.LocalAddr())
+		if aip.IsUnspecified() || !ip.Equal(aip) || port == aport {
+			continue
+		}
+		for _, b := range srv.conns {
+			bip, bport := SockAddr(b.LocalAddr())
+			if bip.IsUnspecified() || bip.Equal(ip) || aport != bport {
 				continue
 			}
-			for _, b := range srv.conns {
-				bip, bport := SockAddr(b.LocalAddr())
-				if bip.IsUnspecified() || bip.Equal(ip) || aport != bport {
-					continue
-				}
-				res.Set(Addr(AttrOtherAddress, b.LocalAddr()))
-				break other
-			}
+			return b.LocalAddr()
 		}
-
-		srv.agent.Send(res, to)
 	}
+	return nil
 }
 
 func (srv *Server) addConn(c net.PacketConn) {
@@ -114,12 +304,40 @@ func (srv *Server) removeConn(c net.PacketConn) {
 	srv.mu.Unlock()
 }
 
+// Shutdown stops handling new messages, drains running handlers so they can send their responses, and closes
+// the server. If the context is done first, the server is closed and the context error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.shutdown = true
+	srv.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	srv.Close()
+	return err
+}
+
+// Close closes all packet connections, listeners and accepted stream connections.
 func (srv *Server) Close() error {
-	srv.mu.RLock()
-	defer srv.mu.RUnlock()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 	for _, it := range srv.conns {
 		it.Close()
 	}
-	srv.conns = nil
+	for _, it := range srv.listeners {
+		it.Close()
+	}
+	for it := range srv.streams {
+		it.Close()
+	}
+	srv.conns, srv.listeners = nil, nil
 	return nil
 }
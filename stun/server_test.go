@@ -0,0 +1,205 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenAndServeRFC5780(t *testing.T) {
+	srv := NewServer(nil)
+	for _, it := range [][2]string{
+		{"127.0.0.1", "127.0.0.1"},
+		{"127.0.0.1", ""},
+		{"0.0.0.0", "127.0.0.2"},
+		{"127.0.0.1", "::1"},
+	} {
+		if err := srv.ListenAndServeRFC5780(it[0], it[1], 3478, 3479); err == nil {
+			t.Errorf("%v: expected error", it)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, srv *Server) (*Conn, net.Addr) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(c)
+	conn, err := Dial("stun:"+c.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, c.LocalAddr()
+}
+
+func TestResponseOrigin(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	conn, addr := newTestServer(t, srv)
+	defer conn.Close()
+	res, err := conn.Request(&Message{Type: MethodBinding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := res.GetAddr("udp", AttrResponseOrigin); !sameAddr(origin, addr) {
+		t.Error("wrong response origin:", origin)
+	}
+}
+
+func TestResponseOriginWildcard(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	c, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(c)
+	config := DefaultConfig.Clone()
+	config.TransactionTimeout = 500 * time.Millisecond
+	conn, err := Dial("stun:127.0.0.1:"+strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	res, err := conn.Request(&Message{Type: MethodBinding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Has(AttrResponseOrigin) {
+		t.Error("unspecified response origin:", res)
+	}
+	d := NewDetector(conn)
+	if err = d.DiscoverChange(ChangeIP); err == nil {
+		t.Error("IP address change is reported by a single address server")
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	var n int32
+	srv.Use(func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, msg *Message) {
+			atomic.AddInt32(&n, 1)
+			h.ServeSTUN(w, msg)
+		})
+	})
+	srv.HandleFunc(MethodRefresh|KindRequest, func(w ResponseWriter, msg *Message) {
+		w.Success(Int(AttrLifetime, 600))
+	})
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+
+	if _, err := conn.Request(&Message{Type: MethodBinding}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.Request(&Message{Type: MethodRefresh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := res.Lifetime(); !ok || v != 10*time.Minute {
+		t.Error("wrong lifetime:", v)
+	}
+	_, err = conn.Request(&Message{Type: MethodAllocate})
+	if e, ok := err.(*Error); !ok || e.Code != CodeBadRequest {
+		t.Error("wrong error:", err)
+	}
+	if v := atomic.LoadInt32(&n); v != 3 {
+		t.Error("wrong number of middleware calls:", v)
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	key := []byte("secret")
+	srv := NewServer(nil)
+	defer srv.Close()
+	srv.HandleFunc(MethodRefresh|KindRequest, func(w ResponseWriter, msg *Message) {
+		w.SetSession(&Session{Key: key})
+		w.Error(CodeAllocationMismatch, String(AttrSoftware, "test"))
+	})
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+	res, _, err := conn.agent.RoundTrip(&Message{Type: MethodRefresh, Attributes: []Attr{Fingerprint}}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != MethodRefresh|KindError {
+		t.Error("wrong message type:", res.Type)
+	}
+	if e := res.GetError(); e == nil || e.Code != CodeAllocationMismatch {
+		t.Error("wrong error:", e)
+	}
+	if !res.CheckIntegrity(key) || !res.CheckFingerprint() {
+		t.Error("integrity check failed")
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	srv := NewServer(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeListener(l) }()
+	conn, err := DialURI(&URI{Scheme: "stun", Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, Transport: "tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mapped, err := conn.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameAddr(mapped, conn.LocalAddr()) {
+		t.Errorf("wrong mapped address: %v", mapped)
+	}
+	srv.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener is not closed")
+	}
+	if _, err = conn.Discover(); err == nil {
+		t.Error("connection is not closed")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	started, release := make(chan struct{}), make(chan struct{})
+	srv.HandleFunc(MethodBinding|KindRequest, func(w ResponseWriter, msg *Message) {
+		close(started)
+		<-release
+		w.Success()
+	})
+	conn, _ := newTestServer(t, srv)
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Request(&Message{Type: MethodBinding})
+		errc <- err
+	}()
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown does not wait for the handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Error("response of the running handler is not sent:", err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
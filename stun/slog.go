@@ -0,0 +1,87 @@
+//go:build go1.21
+
+package stun
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+)
+
+// SlogTracer writes trace events to a structured logger.
+type SlogTracer struct {
+	Logger *slog.Logger
+	// Level of events, failed sends and transactions are logged at warning level.
+	// Decode errors are logged at Level, so garbage sent by anyone does not flood the log.
+	Level slog.Level
+	// Data, if true raw messages are logged in hex
+	Data bool
+}
+
+// NewSlogTracer returns a tracer logging events at debug level.
+func NewSlogTracer(l *slog.Logger) *SlogTracer {
+	return &SlogTracer{Logger: l, Level: slog.LevelDebug}
+}
+
+func (t *SlogTracer) OnSend(e *TraceEvent) {
+	t.log("stun send", e)
+}
+
+func (t *SlogTracer) OnReceive(e *TraceEvent) {
+	t.log("stun receive", e)
+}
+
+func (t *SlogTracer) OnDecodeError(e *TraceEvent) {
+	t.logAt(t.Level, "stun decode error", e)
+}
+
+func (t *SlogTracer) OnTransactionStart(e *TraceEvent) {
+	t.log("stun transaction start", e)
+}
+
+func (t *SlogTracer) OnTransactionEnd(e *TraceEvent) {
+	t.log("stun transaction end", e)
+}
+
+func (t *SlogTracer) log(text string, e *TraceEvent) {
+	level := t.Level
+	if e.Err != nil && level < slog.LevelWarn {
+		level = slog.LevelWarn
+	}
+	t.logAt(level, text, e)
+}
+
+func (t *SlogTracer) logAt(level slog.Level, text string, e *TraceEvent) {
+	l := t.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Any("local", e.LocalAddr),
+		slog.Any("remote", e.RemoteAddr),
+	}
+	if msg := e.Message; msg != nil && len(msg.Transaction) > 0 {
+		attrs = append(attrs,
+			slog.String("method", methodLabel(msg)),
+			slog.String("kind", kindLabel(msg)),
+			slog.String("transaction", hex.EncodeToString(msg.Transaction)),
+		)
+	}
+	if res := e.Response; res != nil {
+		attrs = append(attrs, slog.String("result", resultLabel(res, nil)), slog.Duration("rtt", e.RTT))
+	}
+	if e.Data != nil {
+		attrs = append(attrs, slog.Int("size", len(e.Data)))
+		if t.Data {
+			attrs = append(attrs, slog.String("data", hex.EncodeToString(e.Data)))
+		}
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	}
+	l.LogAttrs(ctx, level, text, attrs...)
+}
@@ -0,0 +1,79 @@
+//go:build go1.21
+
+package stun
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestSlogTracer(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+	_, addr := newTestServer(t, srv)
+	out := &syncBuffer{}
+	config := DefaultConfig.Clone()
+	config.Tracer = NewSlogTracer(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	conn, err := Dial("stun:"+addr.String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Request(&Message{Type: MethodBinding}); err != nil {
+		t.Fatal(err)
+	}
+	// MAPPED-ADDRESS exceeding the message length.
+	b := []byte{0, 1, 0, 4, 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0, 1, 0, 100}
+	conn.agent.ServeTransport(b, conn)
+
+	out.Lock()
+	defer out.Unlock()
+	var events []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		var e map[string]interface{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	for i, it := range []struct {
+		msg, kind string
+	}{
+		{"stun transaction start", "request"},
+		{"stun send", "request"},
+		{"stun receive", "response"},
+		{"stun transaction end", "request"},
+		{"stun decode error", ""},
+	} {
+		if i >= len(events) {
+			t.Fatalf("missing event %q", it.msg)
+		}
+		e := events[i]
+		if e["msg"] != it.msg {
+			t.Fatalf("event %d: %v, expected %q", i, e["msg"], it.msg)
+		}
+		if it.kind != "" && (e["kind"] != it.kind || e["method"] != "Binding") {
+			t.Errorf("event %d: wrong message %v %v", i, e["method"], e["kind"])
+		}
+	}
+	if e := events[3]; e["result"] != "success" || e["rtt"] == nil {
+		t.Errorf("wrong transaction end: %v", e)
+	}
+	if e := events[4]; e["level"] != "DEBUG" || e["error"] == nil {
+		t.Errorf("wrong decode error: %v", e)
+	}
+}
@@ -2,25 +2,27 @@ package stun
 
 import (
 	"crypto/md5"
-	"crypto/tls"
-	"errors"
 	"net"
-	"net/url"
-	"strings"
 )
 
+// Discover returns the server reflexive address of a new connection to the STUN server of the URI.
+// If the server has addresses of both IPv4 and IPv6, Binding transactions are raced, see DialURI.
+// The returned connection shares the socket with the STUN client, see Conn.PacketConn.
 func Discover(uri string) (net.PacketConn, net.Addr, error) {
-	conn, err := Dial(uri, nil)
+	u, err := ParseURI(uri)
 	if err != nil {
 		return nil, nil, err
 	}
-	addr, err := conn.Discover()
+	conn, addr, err := dialDiscover(u, DefaultConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := conn.PacketConn()
 	if err != nil {
 		conn.Close()
 		return nil, nil, err
 	}
-	// TODO: hijack
-	return conn.Conn.(net.PacketConn), addr, nil
+	return c, addr, nil
 }
 
 type AuthMethod func(sess *Session) error
@@ -49,74 +51,12 @@ func ShortTermAuthMethod(password string) AuthMethod {
 	}
 }
 
+// Dial connects to the STUN or TURN server of the URI, see ParseURI.
+// If the URI has credentials, they replace the AuthMethod of the config with long-term credentials.
 func Dial(uri string, config *Config) (*Conn, error) {
-	secure, network, addr, auth, err := parseURI(uri)
-	if err != nil {
-		return nil, err
-	}
-	var conn net.Conn
-	if secure {
-		conn, err = tls.Dial(network, addr, nil)
-	} else {
-		if strings.HasPrefix(network, "udp") {
-			conn, err = dialUDP(network, addr)
-		} else {
-			conn, err = dialTCP(network, addr)
-		}
-	}
+	u, err := ParseURI(uri)
 	if err != nil {
 		return nil, err
 	}
-	if auth != nil {
-		config = config.Clone()
-		config.AuthMethod = auth
-	}
-	return NewConn(conn, config), nil
-}
-
-func parseURI(uri string) (secure bool, network, addr string, auth AuthMethod, err error) {
-	var u *url.URL
-	if u, err = url.Parse(uri); err != nil {
-		return
-	}
-	host, port, e := net.SplitHostPort(u.Opaque)
-	if e != nil {
-		host = u.Opaque
-	}
-	if a := u.User; a != nil {
-		if password, ok := a.Password(); ok {
-			auth = LongTermAuthMethod(a.Username(), password)
-		} else {
-			auth = ShortTermAuthMethod(a.Username())
-		}
-	}
-	network = u.Query().Get("transport")
-	if network == "" {
-		network = "udp"
-	}
-	switch u.Scheme {
-	case "stun", "turn":
-		if port == "" {
-			port = "3478"
-		}
-		switch network {
-		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
-		default:
-			err = errors.New("stun: unsupported transport: " + network)
-		}
-	case "stuns", "turns":
-		if port == "" {
-			port = "5478"
-		}
-		secure = true
-		switch network {
-		case "tcp", "tcp4", "tcp6":
-		default:
-			err = errors.New("stun: unsupported transport: " + network)
-		}
-	default:
-		err = errors.New("stun: unsupported scheme " + u.Scheme)
-	}
-	addr = net.JoinHostPort(host, port)
-	return
+	return DialURI(u, config)
 }
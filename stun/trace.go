@@ -0,0 +1,47 @@
+package stun
+
+import (
+	"net"
+	"time"
+)
+
+// Tracer receives structured events of an agent. Implementations must be safe for concurrent use.
+type Tracer interface {
+	// OnSend is called for each outgoing message.
+	OnSend(e *TraceEvent)
+	// OnReceive is called for each decoded incoming message.
+	OnReceive(e *TraceEvent)
+	// OnDecodeError is called for each incoming message which is not decoded.
+	OnDecodeError(e *TraceEvent)
+	// OnTransactionStart is called when a request is sent for the first time.
+	OnTransactionStart(e *TraceEvent)
+	// OnTransactionEnd is called when a transaction is finished with the response or the error.
+	OnTransactionEnd(e *TraceEvent)
+}
+
+// TraceEvent describes a message or a transaction. Events and their data must not be retained after the call.
+type TraceEvent struct {
+	Time       time.Time
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Data is the raw message, if any
+	Data []byte
+	// Message is the parsed message or the request of a transaction, it may be partially decoded on error
+	Message *Message
+	// Response is the response of a finished transaction, if any
+	Response *Message
+	// RTT is the duration of a finished transaction
+	RTT time.Duration
+	Err error
+}
+
+func newTraceEvent(tr Transport, b []byte, msg *Message, err error) *TraceEvent {
+	return &TraceEvent{
+		Time:       time.Now(),
+		LocalAddr:  tr.LocalAddr(),
+		RemoteAddr: tr.RemoteAddr(),
+		Data:       b,
+		Message:    msg,
+		Err:        err,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"sync"
 )
 
 type Listener interface {
@@ -69,12 +70,22 @@ var (
 	errFormat         = errors.New("stun: format error")
 )
 
+const bufferSize = 2048
+
+// buffers holds array pointers rather than slices, so putting a buffer back does not allocate.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new([bufferSize]byte)
+	},
+}
+
 func getBuffer() []byte {
-	return make([]byte, 2048)
+	return buffers.Get().(*[bufferSize]byte)[:]
 }
 
 func putBuffer(b []byte) {
-	if cap(b) >= 2048 {
+	if cap(b) >= bufferSize {
+		buffers.Put((*[bufferSize]byte)(b[:bufferSize]))
 	}
 }
 
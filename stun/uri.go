@@ -0,0 +1,197 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URI is a STUN or TURN URI as defined in RFC 7064 and RFC 7065, e.g. "stun:example.org" or "turns:[2001:db8::1]:5349?transport=tcp".
+// Credentials in the user information, e.g. "turn:user:password@example.org", are accepted as an extension.
+type URI struct {
+	// Scheme is stun, stuns, turn or turns
+	Scheme string
+	// Host is a host name or an IP address, IPv6 addresses are without brackets
+	Host string
+	// Port is the port of the URI, or zero if not specified, so the server is looked up using DNS SRV records
+	Port int
+	// Transport is udp or tcp, or empty if not specified. ParseURI accepts it for TURN URIs only,
+	// as RFC 7064 defines no transport of STUN URIs, but it may be set to dial a STUN server over TCP.
+	Transport string
+	Username  string
+	Password  string
+}
+
+// Default ports defined by RFC 7064 and RFC 7065.
+const (
+	DefaultPort       = 3478
+	DefaultSecurePort = 5349
+)
+
+// ParseURI parses and validates a STUN or TURN URI.
+func ParseURI(s string) (*URI, error) {
+	fail := func(reason string) (*URI, error) {
+		return nil, errors.New("stun: invalid URI " + strconv.Quote(s) + ": " + reason)
+	}
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return fail("missing scheme")
+	}
+	u := &URI{Scheme: strings.ToLower(s[:i])}
+	switch u.Scheme {
+	case "stun", "stuns", "turn", "turns":
+	default:
+		return fail("unsupported scheme " + strconv.Quote(s[:i]))
+	}
+	rest := s[i+1:]
+	if strings.HasPrefix(rest, "//") {
+		return fail("unexpected \"//\", the form is " + u.Scheme + ":host[:port]")
+	}
+	if strings.ContainsAny(rest, "#/") {
+		return fail("unexpected path or fragment")
+	}
+	if i = strings.IndexByte(rest, '?'); i >= 0 {
+		if u.Scheme == "stun" || u.Scheme == "stuns" {
+			return fail("unexpected query, " + u.Scheme + " URIs have no transport")
+		}
+		q, err := url.ParseQuery(rest[i+1:])
+		if err != nil {
+			return fail(err.Error())
+		}
+		for k, v := range q {
+			if k != "transport" || len(v) != 1 {
+				return fail("unsupported query " + strconv.Quote(rest[i+1:]))
+			}
+			u.Transport = strings.ToLower(v[0])
+		}
+		rest = rest[:i]
+	}
+	if i = strings.LastIndexByte(rest, '@'); i >= 0 {
+		info := rest[:i]
+		rest = rest[i+1:]
+		user, pass := info, ""
+		if j := strings.IndexByte(info, ':'); j >= 0 {
+			user, pass = info[:j], info[j+1:]
+		}
+		var err error
+		if u.Username, err = url.PathUnescape(user); err != nil {
+			return fail(err.Error())
+		}
+		if u.Password, err = url.PathUnescape(pass); err != nil {
+			return fail(err.Error())
+		}
+		if u.Username == "" || u.Password == "" {
+			return fail("credentials require a username and a password")
+		}
+	}
+	host, port := rest, ""
+	if strings.HasPrefix(rest, "[") {
+		i = strings.IndexByte(rest, ']')
+		if i < 0 {
+			return fail("missing \"]\" of IPv6 address")
+		}
+		host, port = rest[1:i], rest[i+1:]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return fail("invalid IPv6 address " + strconv.Quote(host))
+		}
+		if port != "" && port[0] != ':' {
+			return fail("unexpected " + strconv.Quote(port) + " after IPv6 address")
+		}
+	} else if i = strings.IndexByte(rest, ':'); i >= 0 {
+		host, port = rest[:i], rest[i:]
+		if strings.IndexByte(port[1:], ':') >= 0 {
+			return fail("IPv6 address must be enclosed in brackets")
+		}
+	}
+	if host == "" {
+		return fail("missing host")
+	}
+	if !strings.HasPrefix(rest, "[") {
+		for _, c := range host {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+				return fail("invalid host " + strconv.Quote(host))
+			}
+		}
+	}
+	u.Host = host
+	if port != "" {
+		p, err := strconv.Atoi(port[1:])
+		if err != nil || p <= 0 || p > 0xffff {
+			return fail("invalid port " + strconv.Quote(port[1:]))
+		}
+		u.Port = p
+	}
+	switch u.Transport {
+	case "", "tcp":
+	case "udp":
+		if u.Secure() {
+			return fail("DTLS is not supported, the transport of " + u.Scheme + " must be tcp")
+		}
+	default:
+		return fail("unsupported transport " + strconv.Quote(u.Transport))
+	}
+	return u, nil
+}
+
+// Secure reports whether the scheme requires TLS.
+func (u *URI) Secure() bool {
+	return u.Scheme == "stuns" || u.Scheme == "turns"
+}
+
+// Network returns the transport, or the default transport of the scheme if not specified.
+func (u *URI) Network() string {
+	switch {
+	case u.Transport != "":
+		return u.Transport
+	case u.Secure():
+		return "tcp"
+	}
+	return "udp"
+}
+
+// Addr returns the host and the port, or the default port of the scheme, joined, e.g. "[2001:db8::1]:3478".
+func (u *URI) Addr() string {
+	port := u.Port
+	if port == 0 {
+		port = u.defaultPort()
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
+
+func (u *URI) defaultPort() int {
+	if u.Secure() {
+		return DefaultSecurePort
+	}
+	return DefaultPort
+}
+
+// String returns the URI with the lower case scheme.
+func (u *URI) String() string {
+	b := &strings.Builder{}
+	b.WriteString(u.Scheme)
+	b.WriteByte(':')
+	if u.Username != "" {
+		b.WriteString(escapeUserinfo(u.Username))
+		b.WriteByte(':')
+		b.WriteString(escapeUserinfo(u.Password))
+		b.WriteByte('@')
+	}
+	if strings.IndexByte(u.Host, ':') >= 0 {
+		b.WriteString("[" + u.Host + "]")
+	} else {
+		b.WriteString(u.Host)
+	}
+	if u.Port != 0 {
+		b.WriteString(":" + strconv.Itoa(u.Port))
+	}
+	if u.Transport != "" {
+		b.WriteString("?transport=" + u.Transport)
+	}
+	return b.String()
+}
+
+func escapeUserinfo(s string) string {
+	return strings.NewReplacer(":", "%3A", "@", "%40").Replace(url.PathEscape(s))
+}
@@ -0,0 +1,65 @@
+package stun
+
+import "testing"
+
+func TestParseURI(t *testing.T) {
+	for _, it := range []struct {
+		uri, canonical, network, addr string
+		secure                        bool
+	}{
+		{"stun:example.org", "", "udp", "example.org:3478", false},
+		{"STUN:example.org:19302", "stun:example.org:19302", "udp", "example.org:19302", false},
+		{"stuns:example.org", "", "tcp", "example.org:5349", true},
+		{"turns:example.org:5349?transport=tcp", "", "tcp", "example.org:5349", true},
+		{"turn:192.0.2.1?transport=tcp", "", "tcp", "192.0.2.1:3478", false},
+		{"stun:[2001:db8::1]", "", "udp", "[2001:db8::1]:3478", false},
+		{"stun:[2001:db8::1]:3479", "", "udp", "[2001:db8::1]:3479", false},
+		{"turn:user:p%40ss@example.org", "", "udp", "example.org:3478", false},
+	} {
+		u, err := ParseURI(it.uri)
+		if err != nil {
+			t.Errorf("%s: %v", it.uri, err)
+			continue
+		}
+		canonical := it.canonical
+		if canonical == "" {
+			canonical = it.uri
+		}
+		if s := u.String(); s != canonical {
+			t.Errorf("%s: wrong string %q", it.uri, s)
+		}
+		if u.Network() != it.network || u.Addr() != it.addr || u.Secure() != it.secure {
+			t.Errorf("%s: wrong %v %v %v", it.uri, u.Network(), u.Addr(), u.Secure())
+		}
+	}
+	u, _ := ParseURI("turn:user:p%40ss@example.org")
+	if u.Username != "user" || u.Password != "p@ss" {
+		t.Errorf("wrong credentials: %q %q", u.Username, u.Password)
+	}
+	for _, it := range []string{
+		"example.org",
+		"http://example.org",
+		"stun://example.org",
+		"stun:",
+		"stun:example.org/path",
+		"stun:example.org:0",
+		"stun:example.org:65536",
+		"stun:example.org:port",
+		"stun:2001:db8::1",
+		"stun:[2001:db8::1",
+		"stun:[192.0.2.1]",
+		"stun:user@example.org",
+		"stun:exa mple.org",
+		"stun:example.org?transport=sctp",
+		"stun:example.org?foo=bar",
+		"stuns:example.org?transport=udp",
+		"stun:example.org?transport=udp",
+		"stuns:example.org?transport=tcp",
+		"turn:example.org?transport=udp4",
+		"turns:example.org?transport=tcp6",
+	} {
+		if u, err := ParseURI(it); err == nil {
+			t.Errorf("%s: expected error, got %v", it, u)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package stun
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Validation errors returned by Message.Validate and Message.UnmarshalStrict.
+var (
+	ErrNoMagicCookie     = errors.New("stun: no magic cookie")
+	ErrBadMessageType    = errors.New("stun: most significant bits of message type are not zero")
+	ErrBadMessageLength  = errors.New("stun: message length is not a multiple of 4")
+	ErrBadMessageKind    = errors.New("stun: message kind is not allowed for the method")
+	ErrBadAttributeOrder = errors.New("stun: attribute follows MESSAGE-INTEGRITY or FINGERPRINT")
+	ErrMissingAttribute  = errors.New("stun: missing required attribute")
+)
+
+// UnmarshalStrict decodes a message like Unmarshal and checks RFC 5389 framing rules:
+// message length must be a multiple of 4, only FINGERPRINT may follow MESSAGE-INTEGRITY
+// and no attribute may follow FINGERPRINT. Then it validates the message using Validate.
+// If the message is framed but invalid, it returns the message length with the error.
+func (m *Message) UnmarshalStrict(b []byte) (n int, err error) {
+	if n = messageLen(b); n > 0 && be.Uint16(b[2:])&3 != 0 {
+		return n, ErrBadMessageLength
+	}
+	n, err = m.Unmarshal(b)
+	if err != nil {
+		return
+	}
+	var last uint16
+	for _, attr := range m.Attributes {
+		typ := attr.Type()
+		if last == AttrFingerprint || last == AttrMessageIntegrity && typ != AttrFingerprint {
+			return n, &errAttribute{ErrBadAttributeOrder, typ}
+		}
+		last = typ
+	}
+	return n, m.Validate()
+}
+
+// Validate checks that the message has the magic cookie, a valid message type,
+// a kind allowed for the method and the attributes required for the method and kind.
+func (m *Message) Validate() error {
+	if len(m.Transaction) < 16 || !bytes.Equal(m.Transaction[:4], magicCookie) {
+		return ErrNoMagicCookie
+	}
+	if m.Type&0xc000 != 0 {
+		return ErrBadMessageType
+	}
+	if kinds, ok := methodKinds[m.Method()]; ok && !kinds[m.Kind()] {
+		return ErrBadMessageKind
+	}
+	if m.Kind() == KindError && !m.Has(AttrErrorCode) {
+		return &errAttribute{ErrMissingAttribute, AttrErrorCode}
+	}
+	for _, typ := range requiredAttrs[m.Type] {
+		if !m.Has(typ) {
+			return &errAttribute{ErrMissingAttribute, typ}
+		}
+	}
+	return nil
+}
+
+var (
+	transactionKinds = map[uint16]bool{KindRequest: true, KindResponse: true, KindError: true}
+	indicationKinds  = map[uint16]bool{KindIndication: true}
+)
+
+// methodKinds contains message kinds allowed for the method.
+var methodKinds = map[uint16]map[uint16]bool{
+	MethodBinding:           {KindRequest: true, KindIndication: true, KindResponse: true, KindError: true},
+	MethodSharedSecret:      transactionKinds,
+	MethodAllocate:          transactionKinds,
+	MethodRefresh:           transactionKinds,
+	MethodSend:              indicationKinds,
+	MethodData:              indicationKinds,
+	MethodCreatePermission:  transactionKinds,
+	MethodChannelBind:       transactionKinds,
+	MethodConnect:           transactionKinds,
+	MethodConnectionBind:    transactionKinds,
+	MethodConnectionAttempt: indicationKinds,
+}
+
+// requiredAttrs contains attributes required by the message type.
+var requiredAttrs = map[uint16][]uint16{
+	MethodBinding | KindResponse:             {AttrXorMappedAddress},
+	MethodAllocate | KindRequest:             {AttrRequestedTransport},
+	MethodAllocate | KindResponse:            {AttrXorRelayedAddress, AttrLifetime, AttrXorMappedAddress},
+	MethodRefresh | KindResponse:             {AttrLifetime},
+	MethodSend | KindIndication:              {AttrXorPeerAddress, AttrData},
+	MethodData | KindIndication:              {AttrXorPeerAddress, AttrData},
+	MethodCreatePermission | KindRequest:     {AttrXorPeerAddress},
+	MethodChannelBind | KindRequest:          {AttrChannelNumber, AttrXorPeerAddress},
+	MethodConnect | KindRequest:              {AttrXorPeerAddress},
+	MethodConnect | KindResponse:             {AttrConnectionID},
+	MethodConnectionBind | KindRequest:       {AttrConnectionID},
+	MethodConnectionAttempt | KindIndication: {AttrXorPeerAddress, AttrConnectionID},
+}
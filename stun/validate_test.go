@@ -0,0 +1,75 @@
+package stun
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalStrict(t *testing.T) {
+	for _, it := range samples {
+		b, err := hex.DecodeString(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = (&Message{}).UnmarshalStrict(b); err != nil {
+			t.Error("valid message:", err)
+		}
+	}
+	tests := []struct {
+		msg *Message
+		err error
+	}{
+		{&Message{Type: MethodBinding, Transaction: make([]byte, 16)}, ErrNoMagicCookie},
+		{&Message{Type: MethodBinding | 0x4000}, ErrBadMessageType},
+		{&Message{Type: MethodSend | KindRequest}, ErrBadMessageKind},
+		{&Message{Type: MethodBinding | KindResponse}, ErrMissingAttribute},
+		{&Message{Type: MethodBinding | KindError}, ErrMissingAttribute},
+		{&Message{Type: MethodChannelBind, Attributes: []Attr{Int(AttrChannelNumber, 0x4000)}}, ErrMissingAttribute},
+		{&Message{Type: MethodBinding | KindResponse, Attributes: []Attr{Addr(AttrXorMappedAddress, nil)}}, nil},
+	}
+	for _, it := range tests {
+		_, err := (&Message{}).UnmarshalStrict(it.msg.Marshal(nil))
+		if !errors.Is(err, it.err) {
+			t.Errorf("%v: wrong error: %v, expected: %v", it.msg, err, it.err)
+		}
+	}
+}
+
+func TestUnmarshalStrictFraming(t *testing.T) {
+	m := &Message{Type: MethodBinding, Attributes: []Attr{Bytes(AttrSoftware, []byte("tes"))}}
+	b := m.Marshal(nil)
+	b = b[:len(b)-1]
+	be.PutUint16(b[2:], uint16(len(b)-20))
+	if _, err := (&Message{}).UnmarshalStrict(b); err != ErrBadMessageLength {
+		t.Error("wrong error:", err)
+	}
+	m = &Message{Type: MethodBinding, Attributes: []Attr{Fingerprint}}
+	b = append(m.Marshal(nil), 0x80, 0x22, 0, 4, 't', 'e', 's', 't')
+	be.PutUint16(b[2:], uint16(len(b)-20))
+	if _, err := (&Message{}).UnmarshalStrict(b); !errors.Is(err, ErrBadAttributeOrder) {
+		t.Error("wrong error:", err)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, it := range samples {
+		b, err := hex.DecodeString(it)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &Message{}
+		if _, err := m.UnmarshalStrict(b); err != nil {
+			return
+		}
+		m.CheckIntegrity(nil)
+		m.CheckFingerprint()
+		_ = m.String()
+		if _, err := UnmarshalMessage(m.Marshal(nil)); err != nil {
+			t.Errorf("%v: %v", m, err)
+		}
+	})
+}